@@ -0,0 +1,94 @@
+package scrubbish
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"errors"
+	"io/fs"
+	"syscall"
+	"path/filepath"
+)
+
+// Returns the path of the backup of path: path with the backup suffix appended,
+// placed in the backup directory (if any) instead of next to path.
+func (o *options) backupPath(path string) string {
+	if o.backupDir == "" {
+		return path + o.backupSuffix
+	}
+	return filepath.Join(o.backupDir, filepath.Base(path) + o.backupSuffix)
+}
+
+// Restore moves the backup of path (see WithBackupSuffix and WithBackupDir) back to path, replacing it,
+// e.g. to roll back a ReplaceMetadata with WithKeepBackup or to recover from a crash.
+func Restore(path string, opts ...Option) error {
+	copyPath := newOptions(opts).backupPath(path)
+	_, err := os.Lstat(copyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no backup to restore: %s", copyPath)
+	}
+	if err != nil { return err }
+	return moveFile(copyPath, path)
+}
+
+// Renames files; a variable so that tests can simulate renames across file systems.
+var rename = os.Rename
+
+// Moves the file from one path to another,
+// falling back to copying and removing it if the paths are on different file systems.
+func moveFile(from, to string) error {
+	err := rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) { return err }
+	err = copyFile(from, to)
+	if err != nil { return err }
+	return os.Remove(from)
+}
+
+// Copies the file, including its permissions and modification time. A partial copy is removed on failure.
+func copyFile(from, to string) (err error) {
+	src, err := os.Open(from)
+	if err != nil { return err }
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil { return err }
+	dst, err := os.OpenFile(to, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, info.Mode().Perm())
+	if err != nil { return err }
+	defer func() {
+		closeErr := dst.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(to)
+		}
+	}()
+	_, err = io.Copy(dst, src)
+	if err != nil { return err }
+	err = dst.Sync()
+	if err != nil { return err }
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
+
+// Clones the file as a reflink sharing its data, including its permissions and modification time.
+// Fails if the file system doesn't support reflinks; nothing is left behind in that case.
+func cloneFile(from, to string) (err error) {
+	src, err := os.Open(from)
+	if err != nil { return err }
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil { return err }
+	dst, err := os.OpenFile(to, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, info.Mode().Perm())
+	if err != nil { return err }
+	defer func() {
+		closeErr := dst.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(to)
+		}
+	}()
+	err = reflink(dst, src)
+	if err != nil { return err }
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,75 @@
+package scrubbish
+
+import (
+	"os"
+	"time"
+	"bytes"
+	"errors"
+	"io/fs"
+	"syscall"
+	"testing"
+	"path/filepath"
+)
+
+// Makes rename fail with EXDEV, as it does across file systems, for the rest of the test.
+func simulateCrossDevice(t *testing.T) {
+	original := rename
+	rename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { rename = original })
+}
+
+func TestMoveFileAcrossFileSystems(t *testing.T) {
+	simulateCrossDevice(t)
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "from.jpg"), filepath.Join(dir, "to.jpg")
+	content := testJPEG{ecsLength: 100}.bytes()
+	err := os.WriteFile(from, content, 0o600)
+	if err != nil { t.Fatal(err) }
+	err = os.Chmod(from, 0o640)
+	if err != nil { t.Fatal(err) }
+	modTime := time.Date(2020, 2, 2, 12, 0, 0, 0, time.UTC)
+	err = os.Chtimes(from, modTime, modTime)
+	if err != nil { t.Fatal(err) }
+
+	err = moveFile(from, to)
+	if err != nil { t.Fatal(err) }
+	_, err = os.Stat(from)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("source not removed: %v", err)
+	}
+	moved, err := os.ReadFile(to)
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(moved, content) {
+		t.Errorf("content not copied")
+	}
+	info, err := os.Stat(to)
+	if err != nil { t.Fatal(err) }
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("permissions %v, want %v", info.Mode().Perm(), fs.FileMode(0o640))
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("modification time %v, want %v", info.ModTime(), modTime)
+	}
+}
+
+func TestReplaceMetadataAcrossFileSystems(t *testing.T) {
+	simulateCrossDevice(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.jpg")
+	image := testJPEG{ecsLength: 100}.bytes()
+	err := os.WriteFile(path, withSegments(image, commentSegment("secret")), 0o666)
+	if err != nil { t.Fatal(err) }
+	err = ReplaceMetadata(path, "")
+	if err != nil { t.Fatal(err) }
+	stripped, err := os.ReadFile(path)
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(stripped, image) {
+		t.Errorf("metadata not stripped")
+	}
+	_, err = os.Stat(path + "~")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("backup not removed: %v", err)
+	}
+}
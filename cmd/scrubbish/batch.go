@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"io"
+	"errors"
+	"fmt"
+	"bytes"
+	"strings"
+	"path/filepath"
+	"io/fs"
+	"sync"
+	"context"
+	"encoding/json"
+
+	"github.com/appgurueu/scrubbish"
+)
+
+type fileError struct {
+	path string
+	err error
+}
+
+// Replaces (or strips, if from is empty) the metadata of each destination independently,
+// so that one failure doesn't abort the rest. Up to -jobs destinations are processed concurrently.
+// Output and errors, including the given ones, are reported at the end, in the order of the destinations,
+// and written to the -report file, if any.
+// Returns the exit code: 0 if there were no errors, exitMalformed if all errors are due to malformed inputs,
+// and exitFailure otherwise.
+func scrubBatch(destinations []string, from string, opts []scrubbish.Option, errs []fileError) int {
+	destinations = dedupe(destinations)
+	outputs := make([]bytes.Buffer, len(destinations))
+	results := make([]error, len(destinations))
+	merges := make([]scrubbish.Result, len(destinations))
+	workers := *jobCount
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = scrubFile(&outputs[i], destinations[i], from, opts, &merges[i])
+			}
+		}()
+	}
+	for i := range destinations {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var report []reportEntry
+	for _, err := range errs {
+		report = append(report, reportEntry{Path: err.path, Status: "error", Error: err.err.Error()})
+	}
+	for i, to := range destinations {
+		os.Stdout.Write(outputs[i].Bytes())
+		if results[i] == nil && !*dryRun {
+			warnResult(to, &merges[i])
+		}
+		if results[i] != nil {
+			errs = append(errs, fileError{to, results[i]})
+			report = append(report, reportEntry{Path: to, Status: "error", Error: results[i].Error()})
+		} else if *dryRun {
+			report = append(report, reportEntry{Path: to, Status: "dry-run", RemovedBytes: merges[i].RemovedBytes})
+		} else {
+			report = append(report, reportEntry{Path: to, Status: "scrubbed", RemovedBytes: merges[i].RemovedBytes})
+		}
+	}
+	code := 0
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "scrubbish: %s: %v\n", err.path, err.err)
+		if code != exitFailure {
+			code = exitCode(err.err)
+		}
+	}
+	if *reportPath != "" {
+		err := writeReport(*reportPath, report)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "scrubbish:", err)
+			code = exitFailure
+		}
+	}
+	return code
+}
+
+// reportEntry is the outcome for a single file in the -report file.
+type reportEntry struct {
+	Path string `json:"path"`
+	Status string `json:"status"` // "scrubbed", "dry-run" or "error"
+	RemovedBytes int `json:"removedBytes,omitempty"` // of metadata (that would be) removed
+	Error string `json:"error,omitempty"`
+}
+
+// Writes the report as a JSON array.
+func writeReport(path string, report []reportEntry) error {
+	if report == nil {
+		report = []reportEntry{}
+	}
+	data, err := json.Marshal(report)
+	if err != nil { return err }
+	return os.WriteFile(path, append(data, '\n'), 0o666)
+}
+
+// Removes duplicate paths, which would otherwise be processed concurrently using the same backup.
+func dedupe(paths []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, path := range paths {
+		clean := filepath.Clean(path)
+		if !seen[clean] {
+			seen[clean] = true
+			unique = append(unique, path)
+		}
+	}
+	return unique
+}
+
+// Processes a single destination of a batch, writing any output to w and storing the result of the merge in result.
+func scrubFile(w io.Writer, to, from string, opts []scrubbish.Option, result *scrubbish.Result) error {
+	// Don't append to the shared slice
+	opts = append(opts[:len(opts):len(opts)], scrubbish.WithResult(result))
+	if *dryRun {
+		var summary bytes.Buffer
+		err := reportDryRun(&summary, to, from, opts)
+		if err != nil { return err }
+		_, err = fmt.Fprintf(w, "%s: %s", to, summary.Bytes())
+		return err
+	}
+	return replaceMetadata(to, from, withLogger(opts, to))
+}
+
+// Replaces (or strips) the metadata of the destination, giving up after -timeout, if any.
+func replaceMetadata(to, from string, opts []scrubbish.Option) error {
+	return withTimeout(func(ctx context.Context) error {
+		return scrubbish.ReplaceMetadataContext(ctx, to, from, opts...)
+	})
+}
+
+// Runs process with a context which is done after -timeout, if any, reporting when that is the case.
+func withTimeout(process func(ctx context.Context) error) error {
+	if *timeout <= 0 {
+		return process(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	err := process(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %v", *timeout)
+	}
+	return err
+}
+
+// Expands the paths, walking directories recursively
+// and keeping only JPEG, WebP, PNG and TIFF files matching the pattern and extensions.
+func collectFiles(paths []string) (files []string, errs []fileError) {
+	exts := strings.Split(*extensions, ",")
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				errs = append(errs, fileError{path, err})
+				return nil
+			}
+			if entry.IsDir() || !entry.Type().IsRegular() {
+				return nil
+			}
+			matches, err := filepath.Match(*pattern, entry.Name())
+			if err != nil { return err }
+			if !matches || !hasExtension(entry.Name(), exts) {
+				return nil
+			}
+			supported, err := hasSupportedMagic(path)
+			if err != nil {
+				errs = append(errs, fileError{path, err})
+			} else if supported {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fileError{root, err})
+		}
+	}
+	return files, errs
+}
+
+func hasExtension(name string, exts []string) bool {
+	for _, ext := range exts {
+		if strings.EqualFold(filepath.Ext(name), strings.TrimSpace(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the file is in a format supported by scrubbish.
+func hasSupportedMagic(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil { return false, err }
+	defer file.Close()
+	_, err = scrubbish.DetectFormat(file)
+	if errors.Is(err, scrubbish.ErrUnknownFormat) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"bufio"
+	"fmt"
+	"flag"
+	"strings"
+)
+
+// Reads a config file selecting the markers to keep or strip, one per line, as in
+//
+//	# Keep ICC profiles and the Adobe color transform
+//	keep APP2
+//	keep Adobe
+//
+// Blank lines and lines starting with # are ignored. The markers are used for -keep and -strip
+// unless these are given on the command line, which overrides the config file.
+func applyConfig(path string) error {
+	file, err := os.Open(path)
+	if err != nil { return err }
+	defer file.Close()
+	var configKeep, configStrip markerList
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		directive, markers, _ := strings.Cut(text, " ")
+		var list *markerList
+		switch directive {
+			case "keep":
+				list = &configKeep
+			case "strip":
+				list = &configStrip
+			default:
+				return fmt.Errorf("%s:%d: unknown directive %q (expected keep or strip)", path, line, directive)
+		}
+		err = list.Set(strings.TrimSpace(markers))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	err = scanner.Err()
+	if err != nil { return err }
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if !given["keep"] {
+		keep = configKeep
+	}
+	if !given["strip"] {
+		strip = configStrip
+	}
+	return nil
+}
@@ -0,0 +1,684 @@
+/*
+Scrubbish takes metadata (EXIF, copyright info, comments) from a source JPEG file
+and replaces (or strips, if no source is provided) the metadata of a destination JPEG file with it.
+WebP files (ICCP, EXIF and XMP chunks), PNG files (eXIf, iCCP, text and tIME chunks)
+and TIFF files (EXIF, GPS, XMP, ICC, IPTC and vendor metadata tags such as maker notes) are supported as well, detected by their header;
+their metadata may be taken from a JPEG or WebP source, that of PNGs also from a PNG source,
+and that of TIFFs also from a TIFF source. The metadata of JPEGs may be taken from a WebP source as well.
+HEIF files such as HEIC photos are supported as sources for all formats; their EXIF and XMP items are copied.
+
+Usage:
+
+    scrubbish [flags] [source] destination
+    scrubbish [flags] -o output [source] destination
+    scrubbish [flags] -batch [-source source] destination...
+    scrubbish [flags] -recursive [-source source] path...
+    scrubbish [flags] -stats [-recursive] [-csv file] path...
+
+    scrubbish -list file
+    scrubbish -json file
+    scrubbish -validate file
+    scrubbish -selftest
+    scrubbish [flags] -extract output file
+    scrubbish [-backup-suffix suffix] [-backup-dir dir] -restore destination
+
+The flags are:
+
+    -strip-trailer
+        Strip trailing data after EOI.
+        By default, trailing data of the destination will raise an error; trailing data of the source is always ignored.
+    -keep-trailer
+        Copy trailing data after the EOI of the destination verbatim (e.g. images appended by phone cameras).
+        Takes precedence over -strip-trailer.
+    -trailer-markers markers
+        Write the APPn and COM segments with the given comma-separated markers after the EOI instead,
+        for formats expecting metadata there; they follow the trailer of the destination if it is kept.
+        Note that the output then has a trailer, which further runs only accept with -keep-trailer or -strip-trailer.
+    -force
+        Strip the trailer even if it holds images indexed by an MPF segment (burst shots, depth maps, motion photos),
+        which -strip-trailer refuses by default, and overwrite existing backups (e.g. left behind by a crash),
+        which are refused by default as they may be the only good copy of the destination.
+    -repair-eoi
+        Tolerate files which end without an EOI (e.g. truncated downloads) if everything up to the end
+        parses cleanly, appending the missing EOI. By default, a missing EOI will raise an error.
+    -keep markers
+        Keep the given comma-separated markers (names like APP2 or hex bytes like 0xE2)
+        rather than treating them as metadata, e.g. -keep APP2 to preserve ICC profiles.
+        The aliases JFIF (APP0), EXIF (APP1), ICC (APP2), Ducky (APP12), IPTC (APP13) and Adobe (APP14)
+        may be used instead of marker names, e.g. -keep IPTC.
+    -strip markers
+        Treat only the given comma-separated markers as metadata, e.g. -strip APP1,COM
+        to strip EXIF and comments but keep all other metadata.
+        Adobe APP14 segments are kept unless APP14 is given explicitly: They hold the color transform
+        of CMYK and YCCK images, which render with wrong (e.g. inverted) colors without it.
+    -config file
+        Read the markers to keep or strip from a file, one per line, e.g. "keep APP2" or "strip COM".
+        Blank lines and lines starting with # are ignored. -keep and -strip on the command line
+        override the respective markers of the config file.
+    -strip-gps
+        Only remove GPS information from EXIF instead of stripping EXIF entirely,
+        keeping e.g. camera model, timestamps and orientation.
+    -strip-makernote
+        Only remove the maker note (proprietary vendor data, e.g. serial numbers) from EXIF
+        instead of stripping EXIF entirely. May be combined with -strip-gps. By default, the maker note is kept.
+    -redact-dates
+        Keep EXIF but blank its timestamps (DateTime, DateTimeOriginal and DateTimeDigitized),
+        e.g. for datasets which must keep technical information but not when photos were taken.
+        May be combined with -strip-gps and -strip-makernote.
+    -keep-xmp
+        Keep XMP (APP1 segments identified by the XMP namespace) while stripping or replacing EXIF.
+    -strip-xmp
+        Keep EXIF while stripping or replacing XMP; other APP1 segments are kept as well.
+    -icc-only
+        Only replace the ICC color profile (APP2) of the destination with that of the source,
+        keeping all other metadata of the destination, e.g. to transplant a profile from a reference image.
+        Takes precedence over -keep, -strip and the like.
+    -keep-if-empty
+        Leave the metadata of the destination alone if the source holds no metadata (as selected by the other flags).
+        Without it, replacing the metadata with that of such a source strips the destination, with a warning.
+    -dedup
+        Drop metadata segments of the source which are byte-identical to one copied before, e.g. repeated comments.
+    -max-meta bytes
+        Fail if the metadata segments copied from the source exceed bytes in total,
+        e.g. to protect against pathological untrusted inputs (default 0: unlimited).
+    -max-size bytes
+        Fail before processing if the destination or the source exceeds bytes
+        (default 0: unlimited). Streams are aborted as soon as the limit is exceeded.
+    -keep-orientation
+        When stripping, keep the EXIF orientation tag (if any) so that images still display upright.
+    -keep-thumbnail
+        When stripping, keep the EXIF thumbnail (if any) along with IFD1, which describes it,
+        so that galleries needn't regenerate it.
+    -comment text
+        Add a comment (COM segment) containing text after the metadata,
+        e.g. a copyright or license note. Long comments are split across several segments.
+    -metadata-first
+        Place the metadata (and comment) right after SOI instead of after the JFIF (APP0) segment of the destination,
+        which by convention comes first.
+    -exif-from file
+        Replace the metadata of the destination with the raw EXIF payload or TIFF structure (e.g. a DNG sidecar)
+        in file, wrapped in an APP1 segment, instead of taking metadata from a source JPEG.
+    -strict
+        Fail on questionable input rather than passing it through: results holding both a JFIF (APP0)
+        and an EXIF (APP1) segment, which some decoders reject, and JPEGs using reserved markers
+        (0x02-0xBF, JPG and JPG0-JPG13, e.g. of JPEG-LS), whose segments are copied as they are otherwise.
+        With -verbose, results holding JFIF and EXIF are warned about otherwise.
+    -keep-backup
+        Keep the backup destination~ after success, e.g. to compare it against the result.
+    -verify
+        Re-parse the result before removing the backup; if it is malformed, restore the backup.
+    -verify-scan
+        Check that the image data of the result (all segments but APPn and COM, including the entropy-coded data)
+        is identical to that of the destination by comparing SHA-256 hashes before removing the backup;
+        if it differs, restore the backup. With -verbose, the hash is printed. Only JPEGs are supported.
+    -validate-icc
+        Check that the chunks of copied ICC profiles (APP2 segments) are complete and in order.
+    -preserve-times
+        Give the result the modification time of the destination.
+    -reflink-backup
+        Create the backup as a reflink clone (on file systems supporting it, like Btrfs, XFS or APFS)
+        rather than by moving the destination, falling back to moving it if cloning fails.
+    -backup-suffix suffix
+        Suffix to append to the file name of the backup (default ~).
+    -backup-dir dir
+        Place backups in dir (created if necessary) instead of next to the destination.
+    -in-place
+        Write the result to a temporary file next to the destination and rename it over the destination
+        once complete (and verified), instead of moving the destination to a backup first.
+        The destination is never touched before success, and no backup is left to clean up.
+    -o output
+        Write the result to output instead of the destination, which is left untouched; no backup is made.
+        The result is written to a temporary file next to output and renamed to output once complete (and verified).
+    -buffer bytes
+        Size of the read and write buffers (default 4096), e.g. 1048576 to speed up processing of large files.
+    -batch
+        Treat all arguments as destinations, each of which is processed independently.
+        Errors are reported at the end; the exit code is non-zero if any destination failed.
+    -source file
+        In batch mode, replace the metadata of all destinations with that of file instead of stripping it.
+    -recursive
+        Like -batch, but walk directories among the arguments recursively,
+        processing all JPEG, WebP, PNG and TIFF files matching -pattern and -ext in place; other files are skipped.
+    -pattern glob
+        In recursive mode, only consider files whose name matches the glob (default *).
+    -ext extensions
+        In recursive mode, only consider files with one of the given comma-separated extensions
+        (default .jpg,.jpeg,.webp,.png,.tif,.tiff; case-insensitive).
+    -jobs n
+        In batch and recursive mode, process up to n files concurrently (default: number of CPUs).
+    -timeout duration
+        Give up on a destination after duration (e.g. 30s), restoring it from the backup,
+        so that a pathological file can't stall a batch; the other destinations are still processed.
+        The timeout applies to each destination on its own (default 0: no timeout).
+        It also applies to -o, which then leaves output untouched, and to standard input,
+        in which case standard output may have received partial output.
+    -report file
+        In batch and recursive mode, additionally write the outcome for each file to the given file as a JSON array,
+        e.g. [{"path":"a.jpg","status":"scrubbed","removedBytes":4521},{"path":"b.jpg","status":"error","error":"..."}].
+        The status is "scrubbed", "dry-run" or "error"; removedBytes is omitted if no metadata was removed.
+    -verbose
+        Print the decision on each segment (e.g. "drop APP1 from image (4521 bytes)")
+        and how many metadata bytes were removed from each destination to standard error.
+    -quiet
+        Print nothing but errors, e.g. for scripts relying on the exit code. Takes precedence over -verbose
+        and silences the confirmation of -validate and warnings, such as the one about removing an ICC color profile
+        (which may shift colors; see -keep) or about a source without metadata (see -keep-if-empty); output which was asked for, such as that of -list, is still printed.
+    -dry-run
+        Print a summary of which segments would be added, stripped or kept, without modifying anything.
+    -list
+        List the segments of file (offset, marker and length) instead of modifying anything.
+    -json
+        Like -list, but print the segments as a JSON array.
+    -extract output
+        Write the metadata segments of file (as selected by -keep, -strip and the like), concatenated,
+        to output (- for standard output) instead of modifying anything.
+    -inflate-comments
+        With -list, show the text of comments; with -list and -extract, inflate zlib-compressed comments,
+        as some tools write them, so that they are human-readable. Copied comments are never modified.
+    -stats
+        Instead of modifying anything, print how many of the files (or, with -recursive, of the files found
+        in the directories) hold EXIF, GPS information, XMP, IPTC data, ICC profiles and comments,
+        along with the total bytes of metadata (as selected by -keep, -strip and the like), e.g. for privacy audits.
+    -csv file
+        With -stats, additionally write a line for each file to file (- for standard output instead of the summary)
+        as CSV: the path, the format, whether it holds each kind of metadata, the metadata bytes, and the error, if any.
+    -validate
+        Check that the segments of file appear in a valid order (e.g. SOF before SOS)
+        instead of modifying anything.
+    -selftest
+        Check that scrubbish works on this platform, without touching any files: Synthetic JPEGs with known metadata
+        are stripped, have their metadata replaced and have GPS information removed in memory, and the results are verified.
+    -restore
+        Move the backup of destination (see -backup-suffix and -backup-dir) back in place, replacing destination,
+        e.g. to roll back after -keep-backup or to recover from a crash.
+
+The source is optional; if none is provided, destination will be stripped of metadata,
+otherwise, the metadata of the destination will be replaced with that of the source.
+
+The result keeps the permissions of the destination.
+
+The destination is backed up to destination~ (see -backup-suffix and -backup-dir) during the operation.
+After the operation succeeds, the backup is removed (unless -keep-backup is given);
+if it fails, the backup is restored.
+
+If the destination is -, it is read from standard input instead,
+and the result is written to standard output; no backup is made in this case.
+
+Errors and usage are printed to standard error. The exit code is 0 on success, 1 on failure (e.g. I/O errors),
+2 for wrong arguments and 3 if an input is not a well-formed JPEG, WebP, PNG or TIFF.
+In batch and recursive mode, it is 3 if all failures are due to malformed inputs, and 1 otherwise.
+*/
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"flag"
+	"strings"
+	"runtime"
+	"log"
+	"errors"
+	"context"
+
+	"github.com/appgurueu/scrubbish"
+)
+
+// markerList is a flag.Value accepting comma-separated markers.
+type markerList []byte
+
+func (l *markerList) String() string {
+	names := make([]string, len(*l))
+	for i, marker := range *l {
+		names[i] = fmt.Sprintf("0x%02X", marker)
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *markerList) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		marker, err := scrubbish.ParseMarker(strings.TrimSpace(name))
+		if err != nil { return err }
+		*l = append(*l, marker)
+	}
+	return nil
+}
+
+var stripTrailer = flag.Bool("strip-trailer", false, "Strip an eventual trailer")
+var keepTrailer = flag.Bool("keep-trailer", false, "Keep an eventual trailer of the destination")
+var force = flag.Bool("force", false, "Strip trailers holding MPF images and overwrite existing backups")
+var repairEOI = flag.Bool("repair-eoi", false, "Append a missing EOI instead of failing")
+var keep, strip, trailerMarkers markerList
+func init() {
+	flag.Var(&keep, "keep", "Comma-separated markers to keep rather than treat as metadata")
+	flag.Var(&strip, "strip", "Comma-separated markers to exclusively treat as metadata")
+	flag.Var(&trailerMarkers, "trailer-markers", "Comma-separated markers of segments to write after EOI")
+}
+var configPath = flag.String("config", "", "File listing markers to keep or strip")
+var stripGPS = flag.Bool("strip-gps", false, "Only remove GPS information from EXIF")
+var stripMakerNote = flag.Bool("strip-makernote", false, "Only remove the maker note from EXIF")
+var redactDates = flag.Bool("redact-dates", false, "Only blank the timestamps in EXIF")
+var iccOnly = flag.Bool("icc-only", false, "Only replace the ICC profile, keeping other metadata")
+var keepIfEmpty = flag.Bool("keep-if-empty", false, "Keep the metadata of the destination if the source holds none")
+var keepXMP = flag.Bool("keep-xmp", false, "Keep XMP while stripping EXIF")
+var stripXMP = flag.Bool("strip-xmp", false, "Keep EXIF while stripping XMP")
+var dedup = flag.Bool("dedup", false, "Drop duplicate metadata segments of the source")
+var maxMetadataBytes = flag.Int64("max-meta", 0, "Maximum total bytes of metadata to copy from the source (0: unlimited)")
+var maxFileSize = flag.Int64("max-size", 0, "Maximum size of the destination and the source in bytes (0: unlimited)")
+var keepOrientation = flag.Bool("keep-orientation", false, "Keep the EXIF orientation when stripping")
+var keepThumbnail = flag.Bool("keep-thumbnail", false, "Keep the EXIF thumbnail when stripping")
+var comment = flag.String("comment", "", "Comment to add as a COM segment")
+var metadataFirst = flag.Bool("metadata-first", false, "Place the metadata before the JFIF segment of the destination")
+var exifFrom = flag.String("exif-from", "", "Raw EXIF or TIFF file to take metadata from")
+var strict = flag.Bool("strict", false, "Fail on questionable input, e.g. results holding both JFIF and EXIF")
+var keepBackup = flag.Bool("keep-backup", false, "Keep the backup after success")
+var verifyOutput = flag.Bool("verify", false, "Re-parse the result before removing the backup")
+var verifyScan = flag.Bool("verify-scan", false, "Check that the image data of the result is unchanged")
+var validateICC = flag.Bool("validate-icc", false, "Check that copied ICC profiles are complete")
+var preserveTimes = flag.Bool("preserve-times", false, "Keep the modification time of the destination")
+var reflinkBackup = flag.Bool("reflink-backup", false, "Create the backup as a reflink clone if possible")
+var backupSuffix = flag.String("backup-suffix", "~", "Suffix of the backup file name")
+var backupDir = flag.String("backup-dir", "", "Directory to place backups in")
+var output = flag.String("o", "", "Write the result to this path, leaving the destination untouched")
+var inPlace = flag.Bool("in-place", false, "Rename the result over the destination instead of making a backup")
+var bufferSize = flag.Int("buffer", 4096, "Size of the read and write buffers in bytes")
+var batch = flag.Bool("batch", false, "Treat all arguments as destinations")
+var source = flag.String("source", "", "Source to take metadata from in batch mode")
+var recursive = flag.Bool("recursive", false, "Walk directories recursively")
+var pattern = flag.String("pattern", "*", "Glob file names must match in recursive mode")
+var extensions = flag.String("ext", ".jpg,.jpeg,.webp,.png,.tif,.tiff", "Comma-separated file extensions to consider in recursive mode")
+var reportPath = flag.String("report", "", "File to write the outcome for each file to as JSON in batch mode")
+var stats = flag.Bool("stats", false, "Print how many files hold which metadata")
+var csvPath = flag.String("csv", "", "File to write the metadata of each file to as CSV with -stats")
+var timeout = flag.Duration("timeout", 0, "Maximum time to spend on each destination (0: no timeout)")
+var selfTestFlag = flag.Bool("selftest", false, "Check that scrubbish works on this platform")
+var jobCount = flag.Int("jobs", runtime.NumCPU(), "Number of files to process concurrently in batch mode")
+var verbose = flag.Bool("verbose", false, "Print the decision on each segment and how many metadata bytes were removed")
+var quiet = flag.Bool("quiet", false, "Print nothing but errors")
+var dryRun = flag.Bool("dry-run", false, "Report what would change without modifying anything")
+var list = flag.Bool("list", false, "List the segments of a file without modifying it")
+var listJSON = flag.Bool("json", false, "List the segments of a file as JSON without modifying it")
+var inflateComments = flag.Bool("inflate-comments", false, "Show comments with -list and inflate compressed ones with -list and -extract")
+var extract = flag.String("extract", "", "File to write the metadata segments of a file to")
+var restore = flag.Bool("restore", false, "Move the backup of a destination back in place")
+var validate = flag.Bool("validate", false, "Check the order of the segments of a file without modifying it")
+func main() {
+	flag.Parse()
+	if *selfTestFlag {
+		if flag.NArg() != 0 {
+			usage()
+		}
+		err := selfTest()
+		if err != nil {
+			fail(fmt.Errorf("self-test failed: %w", err))
+		}
+		if !*quiet {
+			fmt.Println("self-test passed")
+		}
+		return
+	}
+	if *list || *listJSON {
+		if flag.NArg() != 1 {
+			usage()
+		}
+		err := listSegments(flag.Arg(0), *listJSON)
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+	if *validate {
+		if flag.NArg() != 1 {
+			usage()
+		}
+		err := validateFile(flag.Arg(0))
+		if err != nil {
+			fail(err)
+		}
+		if !*quiet {
+			fmt.Println(flag.Arg(0) + ": valid")
+		}
+		return
+	}
+	if *configPath != "" {
+		err := applyConfig(*configPath)
+		if err != nil {
+			fail(err)
+		}
+	}
+	opts := libraryOptions()
+	if *exifFrom != "" {
+		exif, err := os.ReadFile(*exifFrom)
+		if err != nil {
+			fail(err)
+		}
+		opts = append(opts, scrubbish.WithEXIF(exif))
+	}
+	if *extract != "" {
+		if flag.NArg() != 1 {
+			usage()
+		}
+		err := extractMetadata(*extract, flag.Arg(0), opts)
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+	if *restore {
+		if flag.NArg() != 1 {
+			usage()
+		}
+		err := scrubbish.Restore(flag.Arg(0), opts...)
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+	if *stats {
+		if flag.NArg() == 0 {
+			usage()
+		}
+		paths := flag.Args()
+		var errs []fileError
+		if *recursive {
+			paths, errs = collectFiles(paths)
+		}
+		os.Exit(printStats(dedupe(paths), opts, errs))
+	}
+	if *batch || *recursive {
+		if flag.NArg() == 0 || *output != "" {
+			usage()
+		}
+		destinations := flag.Args()
+		var errs []fileError
+		if *recursive {
+			destinations, errs = collectFiles(destinations)
+		}
+		os.Exit(scrubBatch(destinations, *source, opts, errs))
+	}
+	var from, to string
+	switch flag.NArg() {
+		case 1:
+			to = flag.Arg(0)
+		case 2:
+			from, to = flag.Arg(0), flag.Arg(1)
+		default:
+			usage()
+	}
+	if *output != "" && to == "-" {
+		usage()
+	}
+	var err error
+	var result scrubbish.Result
+	if !*dryRun {
+		opts = append(opts, scrubbish.WithResult(&result))
+	}
+	if *dryRun {
+		err = reportDryRun(os.Stdout, to, from, opts)
+	} else if to == "-" {
+		err = scrubStdio(from, withLogger(opts, ""))
+	} else if *output != "" {
+		err = withTimeout(func(ctx context.Context) error {
+			return scrubbish.MergeFilesContext(ctx, *output, to, from, withLogger(opts, "")...)
+		})
+	} else {
+		err = replaceMetadata(to, from, withLogger(opts, ""))
+	}
+	if err != nil {
+		fail(err)
+	}
+	warnResult(to, &result)
+}
+
+// Warns on standard error, unless -quiet is given, if the ICC profile of the destination was removed without replacement,
+// which may shift the colors of wide-gamut images, or if the destination was stripped because the source holds no metadata.
+func warnResult(to string, result *scrubbish.Result) {
+	if *quiet {
+		return
+	}
+	prefix := "scrubbish: "
+	if to != "-" {
+		prefix += to + ": "
+	}
+	if result.EmptySource && !*keepIfEmpty {
+		fmt.Fprintln(os.Stderr, prefix + "warning: the source holds no metadata, so the destination was stripped; use -keep-if-empty to leave it alone")
+	}
+	if result.LostICC {
+		fmt.Fprintln(os.Stderr, prefix + "warning: removed the ICC color profile, which may shift colors; use -keep APP2 to keep it")
+	}
+}
+
+// Exit codes
+const (
+	exitFailure = 1 // e.g. I/O errors
+	exitUsage = 2 // wrong arguments
+	exitMalformed = 3 // an input is not a well-formed JPEG, WebP, PNG or TIFF
+)
+
+// Returns the exit code for the error.
+func exitCode(err error) int {
+	var parseErr *scrubbish.ParseError
+	if errors.As(err, &parseErr) || errors.Is(err, scrubbish.ErrUnknownFormat) || errors.Is(err, scrubbish.ErrNotJPEG) {
+		return exitMalformed
+	}
+	return exitFailure
+}
+
+// Prints the error to standard error and exits with the corresponding exit code.
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "scrubbish:", err)
+	os.Exit(exitCode(err))
+}
+
+// Prints the usage and exits.
+func usage() {
+	flag.Usage()
+	os.Exit(exitUsage)
+}
+
+const usageText = `usage:
+  scrubbish [flags] [source] destination
+  scrubbish [flags] -o output [source] destination
+  scrubbish [flags] -batch [-source source] destination...
+  scrubbish [flags] -recursive [-source source] path...
+  scrubbish [flags] -stats [-recursive] [-csv file] path...
+  scrubbish -list|-json file
+  scrubbish -validate file
+  scrubbish -selftest
+  scrubbish [flags] -extract output file
+  scrubbish [-backup-suffix suffix] [-backup-dir dir] -restore destination
+flags:
+`
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usageText)
+		flag.PrintDefaults()
+	}
+}
+
+// Returns the library options corresponding to the flags.
+func libraryOptions() []scrubbish.Option {
+	opts := []scrubbish.Option{scrubbish.WithStripTrailer(*stripTrailer), scrubbish.WithKeep(keep...), scrubbish.WithStrip(strip...)}
+	if *keepTrailer {
+		opts = append(opts, scrubbish.WithKeepTrailer())
+	}
+	if *force {
+		opts = append(opts, scrubbish.WithForce())
+	}
+	if *repairEOI {
+		opts = append(opts, scrubbish.WithRepairEOI())
+	}
+	if *stripGPS {
+		opts = append(opts, scrubbish.WithStripGPS())
+	}
+	if *stripMakerNote {
+		opts = append(opts, scrubbish.WithStripMakerNote())
+	}
+	if *redactDates {
+		opts = append(opts, scrubbish.WithRedactDates())
+	}
+	if *keepXMP {
+		opts = append(opts, scrubbish.WithKeepXMP())
+	}
+	if *iccOnly {
+		opts = append(opts, scrubbish.WithICCOnly())
+	}
+	if *keepIfEmpty {
+		opts = append(opts, scrubbish.WithKeepIfEmptySource())
+	}
+	if *stripXMP {
+		opts = append(opts, scrubbish.WithStripXMP())
+	}
+	if *keepOrientation {
+		opts = append(opts, scrubbish.WithKeepOrientation())
+	}
+	if *keepThumbnail {
+		opts = append(opts, scrubbish.WithKeepThumbnail())
+	}
+	if *dedup {
+		opts = append(opts, scrubbish.WithDedup())
+	}
+	if *maxMetadataBytes > 0 {
+		opts = append(opts, scrubbish.WithMaxMetadataBytes(*maxMetadataBytes))
+	}
+	if *maxFileSize > 0 {
+		opts = append(opts, scrubbish.WithMaxFileSize(*maxFileSize))
+	}
+	opts = append(opts, scrubbish.WithBackupSuffix(*backupSuffix), scrubbish.WithBackupDir(*backupDir), scrubbish.WithBufferSize(*bufferSize))
+	if *verifyOutput {
+		opts = append(opts, scrubbish.WithVerify())
+	}
+	if *verifyScan {
+		opts = append(opts, scrubbish.WithVerifyScan())
+	}
+	if *validateICC {
+		opts = append(opts, scrubbish.WithValidateICC())
+	}
+	if *preserveTimes {
+		opts = append(opts, scrubbish.WithPreserveTimes())
+	}
+	if *reflinkBackup {
+		opts = append(opts, scrubbish.WithReflinkBackup())
+	}
+	if *keepBackup {
+		opts = append(opts, scrubbish.WithKeepBackup())
+	}
+	if *inPlace {
+		opts = append(opts, scrubbish.WithInPlace())
+	}
+	if *comment != "" {
+		opts = append(opts, scrubbish.WithComment(*comment))
+	}
+	if *metadataFirst {
+		opts = append(opts, scrubbish.WithMetadataFirst())
+	}
+	if *strict {
+		opts = append(opts, scrubbish.WithStrict())
+	}
+	if len(trailerMarkers) > 0 {
+		opts = append(opts, scrubbish.WithTrailerMarkers(trailerMarkers...))
+	}
+	if *inflateComments {
+		opts = append(opts, scrubbish.WithInflateComments())
+	}
+	return opts
+}
+
+// Adds a logger to standard error, prefixing messages with the path if it is not empty, if -verbose is given
+// (and -quiet isn't).
+func withLogger(opts []scrubbish.Option, path string) []scrubbish.Option {
+	if !*verbose || *quiet {
+		return opts
+	}
+	prefix := "scrubbish: "
+	if path != "" {
+		prefix += path + ": "
+	}
+	// Don't append to the shared slice
+	return append(opts[:len(opts):len(opts)], scrubbish.WithLogger(log.New(os.Stderr, prefix, 0)))
+}
+
+func listSegments(path string, asJSON bool) error {
+	file, err := os.Open(path)
+	if err != nil { return err }
+	defer file.Close()
+	if asJSON {
+		return scrubbish.ListJSON(os.Stdout, file)
+	}
+	var opts []scrubbish.Option
+	if len(trailerMarkers) > 0 {
+		opts = append(opts, scrubbish.WithTrailerMarkers(trailerMarkers...))
+	}
+	if *inflateComments {
+		opts = append(opts, scrubbish.WithInflateComments())
+	}
+	return scrubbish.List(os.Stdout, file, opts...)
+}
+
+func validateFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil { return err }
+	defer file.Close()
+	return scrubbish.Validate(file)
+}
+
+// Writes the metadata segments of the file at path to output.
+func extractMetadata(output, path string, opts []scrubbish.Option) (err error) {
+	file, err := os.Open(path)
+	if err != nil { return err }
+	defer file.Close()
+	if output == "-" {
+		return scrubbish.Extract(os.Stdout, file, opts...)
+	}
+	outFile, err := os.Create(output)
+	if err != nil { return err }
+	info, err := outFile.Stat()
+	if err != nil {
+		outFile.Close()
+		return err
+	}
+	defer func() {
+		closeErr := outFile.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil && info.Mode().IsRegular() {
+			// Don't leave partial metadata behind
+			os.Remove(output)
+		}
+	}()
+	return scrubbish.Extract(outFile, file, opts...)
+}
+
+// Reads the image from stdin and writes the result to stdout.
+func scrubStdio(from string, opts []scrubbish.Option) error {
+	var metadata io.Reader
+	if from != "" {
+		metaFile, err := os.Open(from)
+		if err != nil { return err }
+		defer metaFile.Close()
+		metadata = metaFile
+	}
+	return withTimeout(func(ctx context.Context) error {
+		return scrubbish.MergeContext(ctx, os.Stdout, os.Stdin, metadata, opts...)
+	})
+}
+
+func reportDryRun(w io.Writer, to, from string, opts []scrubbish.Option) error {
+	var image io.Reader = os.Stdin
+	if to != "-" {
+		imageFile, err := os.Open(to)
+		if err != nil { return err }
+		defer imageFile.Close()
+		image = imageFile
+	}
+	var metadata io.Reader
+	if from != "" {
+		metaFile, err := os.Open(from)
+		if err != nil { return err }
+		defer metaFile.Close()
+		metadata = metaFile
+	}
+	return scrubbish.DryRun(w, image, metadata, opts...)
+}
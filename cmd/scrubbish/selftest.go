@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"bytes"
+	"encoding/binary"
+
+	"github.com/appgurueu/scrubbish"
+)
+
+// Runs round trips on synthetic JPEGs in memory, without touching the file system:
+// stripping, replacing and removing GPS information from EXIF in both byte orders, with small and large buffers.
+// The JPEGs hold segments and entropy-coded data (with stuffed bytes and restart markers) spanning many buffers.
+// Returns the first failure.
+func selfTest() error {
+	image := syntheticJPEG()
+	comment := jpegSegment(0xFE, []byte("scrubbish self-test"))
+	icc := jpegSegment(0xE2, append([]byte("ICC_PROFILE\x00\x01\x01"), bytes.Repeat([]byte("icc"), 20000)...))
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		exif := jpegSegment(0xE1, syntheticEXIF(order))
+		withMetadata := append(append(append(append(append([]byte(nil), image[:2]...), exif...), icc...), comment...), image[2:]...)
+		for _, bufferSize := range []int{4096, 1 << 16} {
+			buffer := scrubbish.WithBufferSize(bufferSize)
+			name := fmt.Sprintf("%v EXIF, %d byte buffers", order, bufferSize)
+			stripped, err := scrubbish.StripBytes(withMetadata, buffer)
+			if err != nil {
+				return fmt.Errorf("stripping (%s): %w", name, err)
+			}
+			if !bytes.Equal(stripped, image) {
+				return fmt.Errorf("stripping (%s): output differs from the image without metadata", name)
+			}
+			replaced, err := scrubbish.ReplaceBytes(image, withMetadata, buffer)
+			if err != nil {
+				return fmt.Errorf("replacing (%s): %w", name, err)
+			}
+			if !bytes.Equal(replaced, withMetadata) {
+				return fmt.Errorf("replacing (%s): output differs from the image with metadata", name)
+			}
+			withoutGPS, err := scrubbish.StripBytes(withMetadata, scrubbish.WithStripGPS(), buffer)
+			if err != nil {
+				return fmt.Errorf("stripping GPS (%s): %w", name, err)
+			}
+			// Only the EXIF segment is kept, without the GPS IFD
+			for _, check := range []struct {
+				data []byte
+				before bool
+			}{{withMetadata, true}, {withoutGPS, false}} {
+				inventory, err := scrubbish.Inspect(bytes.NewReader(check.data), buffer)
+				if err != nil {
+					return fmt.Errorf("stripping GPS (%s): %w", name, err)
+				}
+				if !inventory.EXIF || inventory.GPS != check.before || inventory.ICC != check.before || inventory.Comments != check.before {
+					return fmt.Errorf("stripping GPS (%s): unexpected metadata %+v", name, *inventory)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns a JPEG segment with the marker and payload.
+func jpegSegment(marker byte, payload []byte) []byte {
+	return append([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+}
+
+// Returns a grayscale baseline JPEG without metadata. Its entropy-coded data is made up rather than decodable,
+// which is fine since scrubbish never decodes it.
+func syntheticJPEG() []byte {
+	jpeg := []byte{0xFF, 0xD8}
+	jpeg = append(jpeg, jpegSegment(0xDB, append([]byte{0}, bytes.Repeat([]byte{1}, 64)...))...) // DQT
+	jpeg = append(jpeg, jpegSegment(0xC0, []byte{8, 0, 16, 0, 16, 1, 1, 0x11, 0})...) // SOF0: 16x16, one component
+	jpeg = append(jpeg, jpegSegment(0xC4, append([]byte{0, 1}, make([]byte, 16)...))...) // DHT: a single code for 0
+	jpeg = append(jpeg, jpegSegment(0xDD, []byte{0, 1})...) // DRI
+	jpeg = append(jpeg, jpegSegment(0xDA, []byte{1, 1, 0, 0, 63, 0})...) // SOS
+	for i := 0; i < 100000; i++ {
+		b := byte(i * 31)
+		jpeg = append(jpeg, b)
+		if b == 0xFF {
+			jpeg = append(jpeg, 0) // stuffed
+		}
+		if i % 5000 == 4999 {
+			jpeg = append(jpeg, 0xFF, 0xD0 + byte(i / 5000 % 8)) // RSTn
+		}
+	}
+	return append(jpeg, 0xFF, 0xD9)
+}
+
+// Returns an EXIF payload in the byte order, holding the orientation and a GPS IFD with the GPS version.
+func syntheticEXIF(order binary.ByteOrder) []byte {
+	tiff := make([]byte, 56)
+	copy(tiff, "II")
+	if order == binary.BigEndian {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8) // IFD0
+	order.PutUint16(tiff[8:], 2)
+	entry := func(at int, tag, typ uint16, count uint32) {
+		order.PutUint16(tiff[at:], tag)
+		order.PutUint16(tiff[at + 2:], typ)
+		order.PutUint32(tiff[at + 4:], count)
+	}
+	entry(10, 0x0112, 3, 1) // orientation
+	order.PutUint16(tiff[18:], 1)
+	entry(22, 0x8825, 4, 1) // GPS IFD
+	order.PutUint32(tiff[30:], 38)
+	order.PutUint16(tiff[38:], 1)
+	entry(40, 0x0000, 1, 4) // GPS version
+	copy(tiff[48:], []byte{2, 3, 0, 0})
+	return append([]byte("Exif\x00\x00"), tiff...)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"strconv"
+	"strings"
+	"encoding/csv"
+
+	"github.com/appgurueu/scrubbish"
+)
+
+// The kinds of metadata counted by -stats
+var statsKinds = []struct {
+	name string
+	has func(inventory *scrubbish.Inventory) bool
+}{
+	{"EXIF", func(inventory *scrubbish.Inventory) bool { return inventory.EXIF }},
+	{"GPS", func(inventory *scrubbish.Inventory) bool { return inventory.GPS }},
+	{"XMP", func(inventory *scrubbish.Inventory) bool { return inventory.XMP }},
+	{"IPTC", func(inventory *scrubbish.Inventory) bool { return inventory.IPTC }},
+	{"ICC", func(inventory *scrubbish.Inventory) bool { return inventory.ICC }},
+	{"comments", func(inventory *scrubbish.Inventory) bool { return inventory.Comments }},
+}
+
+// Inspects the metadata of the files without modifying them and prints how many hold each kind of metadata,
+// additionally writing a line for each file to the -csv file, if any.
+// Errors, including the given ones, are reported at the end. Returns the exit code, like scrubBatch.
+func printStats(paths []string, opts []scrubbish.Option, errs []fileError) int {
+	var table *csv.Writer
+	if *csvPath != "" {
+		var out io.Writer = os.Stdout
+		if *csvPath != "-" {
+			file, err := os.Create(*csvPath)
+			if err != nil {
+				fail(err)
+			}
+			defer file.Close()
+			out = file
+		}
+		table = csv.NewWriter(out)
+		header := []string{"path", "format"}
+		for _, kind := range statsKinds {
+			header = append(header, kind.name)
+		}
+		table.Write(append(header, "metadata bytes", "error"))
+	}
+	counts := make([]int, len(statsKinds))
+	var files int
+	var metadataBytes int64
+	for _, path := range paths {
+		inventory, err := inspectFile(path, opts)
+		if err != nil {
+			errs = append(errs, fileError{path, err})
+			if table != nil {
+				row := make([]string, len(statsKinds) + 4)
+				row[0], row[len(row) - 1] = path, err.Error()
+				table.Write(row)
+			}
+			continue
+		}
+		// Malformed metadata segments are reported, but the file is still counted
+		var malformed []string
+		for _, err := range inventory.Errors {
+			errs = append(errs, fileError{path, err})
+			malformed = append(malformed, err.Error())
+		}
+		files++
+		metadataBytes += inventory.MetadataBytes
+		row := []string{path, inventory.Format.String()}
+		for i, kind := range statsKinds {
+			has := kind.has(inventory)
+			if has {
+				counts[i]++
+			}
+			row = append(row, strconv.FormatBool(has))
+		}
+		if table != nil {
+			table.Write(append(row, strconv.FormatInt(inventory.MetadataBytes, 10), strings.Join(malformed, "; ")))
+		}
+	}
+	code := 0
+	if table != nil {
+		table.Flush()
+		if err := table.Error(); err != nil {
+			fmt.Fprintln(os.Stderr, "scrubbish:", err)
+			code = exitFailure
+		}
+	}
+	if *csvPath != "-" {
+		fmt.Printf("%-16s %d\n", "files", files)
+		for i, kind := range statsKinds {
+			fmt.Printf("%-16s %d\n", "with " + kind.name, counts[i])
+		}
+		fmt.Printf("%-16s %d\n", "metadata bytes", metadataBytes)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "scrubbish: %s: %v\n", err.path, err.err)
+		if code != exitFailure {
+			code = exitCode(err.err)
+		}
+	}
+	return code
+}
+
+func inspectFile(path string, opts []scrubbish.Option) (*scrubbish.Inventory, error) {
+	file, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer file.Close()
+	return scrubbish.Inspect(file, opts...)
+}
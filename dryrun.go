@@ -0,0 +1,47 @@
+package scrubbish
+
+import (
+	"io"
+	"fmt"
+	"strings"
+)
+
+// DryRun writes a summary of what Merge would do with the given arguments to w,
+// such as "would strip APP1 (4521 bytes), APP14 (18 bytes); would keep APP0, APP2",
+// without writing any output image.
+// Only APPn and COM segments are listed as kept; other segments are image data.
+func DryRun(w io.Writer, image io.Reader, metadata io.Reader, opts ...Option) error {
+	var added, stripped, kept []string
+	observe := func(seg *segment, fromMetadata, keep bool) {
+		name := seg.displayName()
+		switch {
+			case fromMetadata && keep:
+				added = append(added, fmt.Sprintf("%s (%d bytes)", name, seg.length))
+			case !fromMetadata && !keep:
+				stripped = append(stripped, fmt.Sprintf("%s (%d bytes)", name, seg.length))
+			case !fromMetadata && ((seg.marker >= APP0 && seg.marker <= APP15) || seg.marker == COM):
+				kept = append(kept, name)
+		}
+	}
+	// Don't append to the caller's slice, which may be shared;
+	// don't log what would be done as if it had been done
+	opts = append(opts[:len(opts):len(opts)], func(o *options) { o.observe, o.logger = observe, nil })
+	err := Merge(io.Discard, image, metadata, opts...)
+	if err != nil { return err }
+
+	var summary []string
+	if len(added) > 0 {
+		summary = append(summary, "would add " + strings.Join(added, ", "))
+	}
+	if len(stripped) > 0 {
+		summary = append(summary, "would strip " + strings.Join(stripped, ", "))
+	}
+	if len(summary) == 0 {
+		summary = append(summary, "would change nothing")
+	}
+	if len(kept) > 0 {
+		summary = append(summary, "would keep " + strings.Join(kept, ", "))
+	}
+	_, err = fmt.Fprintln(w, strings.Join(summary, "; "))
+	return err
+}
@@ -0,0 +1,20 @@
+package scrubbish
+
+import "fmt"
+
+// ParseError is returned if an input is not a well-formed JPEG at a segment level.
+// Use errors.As to obtain it from the errors returned by this package.
+type ParseError struct {
+	Offset int64 // of the offending bytes, counted from the start of the input
+	Kind string // what went wrong, e.g. "truncated segment", "invalid tag type" or "unexpected trailer"
+	Msg string // further details, if any, e.g. the offending byte
+}
+
+// Error formats the error like "invalid tag type 0x42 at offset 0x1A30".
+func (e *ParseError) Error() string {
+	kind := e.Kind
+	if e.Msg != "" {
+		kind += " " + e.Msg
+	}
+	return fmt.Sprintf("%s at offset 0x%X", kind, e.Offset)
+}
@@ -0,0 +1,382 @@
+package scrubbish
+
+import (
+	"bytes"
+	"bufio"
+	"errors"
+	"encoding/binary"
+)
+
+// EXIF payloads consist of a header followed by a TIFF structure:
+// A TIFF header and a chain of IFDs (image file directories) starting with IFD0,
+// some of whose entries point to further IFDs (EXIF, GPS, interoperability).
+// IFD1, if present, describes the thumbnail.
+
+const exifHeader = "Exif\x00\x00"
+
+const (
+	tagOrientation = 0x0112
+	tagXResolution = 0x011A
+	tagYResolution = 0x011B
+	tagResolutionUnit = 0x0128
+	tagThumbnailOffset = 0x0201
+	tagThumbnailLength = 0x0202
+	tagMakerNote = 0x927C
+	tagDateTimeOriginal = 0x9003
+	tagDateTimeDigitized = 0x9004
+	tagExifIFD = 0x8769
+	tagGPSIFD = 0x8825
+	tagInteropIFD = 0xA005
+)
+
+// Sizes of the TIFF field types, indexed by type
+var tiffTypeSizes = [...]uint64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// Maximum nesting of IFDs, to bound recursion on malicious input
+const maxIFDDepth = 4
+
+type tiffEntry struct {
+	tag, typ uint16
+	count uint32
+	value []byte // in the byte order of the TIFF
+	sub *tiffIFD // IFD pointed to by the entry, if any
+}
+
+type tiffIFD struct {
+	entries []*tiffEntry
+	thumbnail []byte // pointed to by the thumbnail offset and length entries
+	strips [][]byte // pointed to by the strip or tile offsets and byte counts, for TIFF images (see loadStrips)
+}
+
+type tiff struct {
+	order binary.ByteOrder
+	ifds []*tiffIFD
+}
+
+var errTIFF = errors.New("invalid TIFF structure in EXIF")
+
+func parseTIFF(data []byte) (*tiff, error) {
+	if len(data) < 8 { return nil, errTIFF }
+	t := &tiff{}
+	switch string(data[:2]) {
+		case "II":
+			t.order = binary.LittleEndian
+		case "MM":
+			t.order = binary.BigEndian
+		default:
+			return nil, errTIFF
+	}
+	if t.order.Uint16(data[2:]) != 42 { return nil, errTIFF }
+	p := &tiffParser{data: data, order: t.order, visited: map[uint32]bool{}}
+	offset := t.order.Uint32(data[4:])
+	for offset != 0 {
+		ifd, next, err := p.parseIFD(offset, 0)
+		if err != nil { return nil, err }
+		t.ifds = append(t.ifds, ifd)
+		offset = next
+	}
+	return t, nil
+}
+
+type tiffParser struct {
+	data []byte
+	order binary.ByteOrder
+	visited map[uint32]bool // offsets of IFDs, to detect cycles
+}
+
+func isIFDPointer(tag uint16) bool {
+	return tag == tagExifIFD || tag == tagGPSIFD || tag == tagInteropIFD
+}
+
+func (p *tiffParser) parseIFD(offset uint32, depth int) (ifd *tiffIFD, next uint32, err error) {
+	if depth > maxIFDDepth || p.visited[offset] { return nil, 0, errTIFF }
+	p.visited[offset] = true
+	data := p.data
+	if uint64(offset) + 2 > uint64(len(data)) { return nil, 0, errTIFF }
+	n := uint64(p.order.Uint16(data[offset:]))
+	end := uint64(offset) + 2 + 12*n
+	if end + 4 > uint64(len(data)) { return nil, 0, errTIFF }
+	ifd = &tiffIFD{}
+	for i := uint64(0); i < n; i++ {
+		raw := data[uint64(offset) + 2 + 12*i:]
+		entry := &tiffEntry{
+			tag: p.order.Uint16(raw),
+			typ: p.order.Uint16(raw[2:]),
+			count: p.order.Uint32(raw[4:]),
+		}
+		if int(entry.typ) >= len(tiffTypeSizes) || tiffTypeSizes[entry.typ] == 0 { return nil, 0, errTIFF }
+		size := tiffTypeSizes[entry.typ] * uint64(entry.count)
+		if size <= 4 {
+			entry.value = append([]byte(nil), raw[8:8 + size]...)
+		} else {
+			valueOffset := uint64(p.order.Uint32(raw[8:]))
+			if valueOffset + size > uint64(len(data)) { return nil, 0, errTIFF }
+			entry.value = append([]byte(nil), data[valueOffset:valueOffset + size]...)
+		}
+		if isIFDPointer(entry.tag) && size == 4 {
+			entry.sub, _, err = p.parseIFD(p.order.Uint32(entry.value), depth + 1)
+			if err != nil { return nil, 0, err }
+		}
+		ifd.entries = append(ifd.entries, entry)
+	}
+	offsetEntry, lengthEntry := ifd.entry(tagThumbnailOffset), ifd.entry(tagThumbnailLength)
+	if offsetEntry != nil && lengthEntry != nil && len(offsetEntry.value) == 4 && len(lengthEntry.value) == 4 {
+		thumbOffset := uint64(p.order.Uint32(offsetEntry.value))
+		thumbLength := uint64(p.order.Uint32(lengthEntry.value))
+		if thumbOffset + thumbLength > uint64(len(data)) { return nil, 0, errTIFF }
+		ifd.thumbnail = append([]byte(nil), data[thumbOffset:thumbOffset + thumbLength]...)
+	}
+	return ifd, p.order.Uint32(data[end:]), nil
+}
+
+// Returns the first entry with the tag, or nil if there is none.
+func (ifd *tiffIFD) entry(tag uint16) *tiffEntry {
+	for _, entry := range ifd.entries {
+		if entry.tag == tag {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Removes all entries with the tag from the IFD, reporting whether any were present.
+func (ifd *tiffIFD) remove(tag uint16) bool {
+	entries := ifd.entries[:0]
+	for _, entry := range ifd.entries {
+		if entry.tag != tag {
+			entries = append(entries, entry)
+		}
+	}
+	removed := len(entries) < len(ifd.entries)
+	ifd.entries = entries
+	return removed
+}
+
+// Serializes the TIFF structure, laying out all IFDs and values anew.
+func (t *tiff) bytes() []byte {
+	w := &tiffWriter{order: t.order}
+	if t.order == binary.LittleEndian {
+		w.buf.WriteString("II")
+	} else {
+		w.buf.WriteString("MM")
+	}
+	w.uint16(42)
+	nextPos := w.buf.Len()
+	w.uint32(0)
+	for _, ifd := range t.ifds {
+		offset := w.writeIFD(ifd)
+		w.patch(nextPos, offset)
+		nextPos = int(offset) + 2 + 12*len(ifd.entries)
+	}
+	return w.buf.Bytes()
+}
+
+type tiffWriter struct {
+	buf bytes.Buffer
+	order binary.ByteOrder
+}
+
+func (w *tiffWriter) uint16(v uint16) {
+	var b [2]byte
+	w.order.PutUint16(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *tiffWriter) uint32(v uint32) {
+	var b [4]byte
+	w.order.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *tiffWriter) patch(pos int, v uint32) {
+	w.order.PutUint32(w.buf.Bytes()[pos:], v)
+}
+
+// TIFF values need to start on word boundaries.
+func (w *tiffWriter) align() {
+	if w.buf.Len() % 2 != 0 {
+		w.buf.WriteByte(0)
+	}
+}
+
+// Writes the IFD followed by its out-of-line values and sub-IFDs, returning its offset.
+// The offset of the next IFD is left zero.
+func (w *tiffWriter) writeIFD(ifd *tiffIFD) uint32 {
+	w.align()
+	start := w.buf.Len()
+	w.uint16(uint16(len(ifd.entries)))
+	for _, entry := range ifd.entries {
+		w.uint16(entry.tag)
+		w.uint16(entry.typ)
+		w.uint32(entry.count)
+		var inline [4]byte
+		copy(inline[:], entry.value)
+		w.buf.Write(inline[:])
+	}
+	w.uint32(0)
+	for i, entry := range ifd.entries {
+		valuePos := start + 2 + 12*i + 8
+		switch {
+			case entry.sub != nil:
+				w.patch(valuePos, w.writeIFD(entry.sub))
+			case entry.tag == tagThumbnailOffset && ifd.thumbnail != nil:
+				w.align()
+				w.patch(valuePos, uint32(w.buf.Len()))
+				w.buf.Write(ifd.thumbnail)
+			case entry.tag == tagThumbnailLength && ifd.thumbnail != nil:
+				w.patch(valuePos, uint32(len(ifd.thumbnail)))
+			case (entry.tag == tagStripOffsets || entry.tag == tagTileOffsets) && ifd.strips != nil:
+				offsets := make([]byte, 4*len(ifd.strips))
+				for i, strip := range ifd.strips {
+					w.align()
+					w.order.PutUint32(offsets[4*i:], uint32(w.buf.Len()))
+					w.buf.Write(strip)
+				}
+				if len(offsets) == 4 {
+					copy(w.buf.Bytes()[valuePos:], offsets)
+				} else {
+					w.align()
+					w.patch(valuePos, uint32(w.buf.Len()))
+					w.buf.Write(offsets)
+				}
+			case len(entry.value) > 4:
+				w.align()
+				w.patch(valuePos, uint32(w.buf.Len()))
+				w.buf.Write(entry.value)
+		}
+	}
+	return uint32(start)
+}
+
+// Rewrites the EXIF payload (including the EXIF header), applying modify to the parsed TIFF structure.
+// Returns nil if no IFDs remain.
+func rewriteEXIF(payload []byte, modify func(t *tiff)) ([]byte, error) {
+	if !bytes.HasPrefix(payload, []byte(exifHeader)) { return nil, errTIFF }
+	t, err := parseTIFF(payload[len(exifHeader):])
+	if err != nil { return nil, err }
+	modify(t)
+	if len(t.ifds) == 0 {
+		return nil, nil
+	}
+	return append([]byte(exifHeader), t.bytes()...), nil
+}
+
+// Removes the GPS IFD from all IFDs of the TIFF structure, reporting whether there was any.
+func stripGPS(t *tiff) bool {
+	stripped := false
+	var strip func(ifd *tiffIFD)
+	strip = func(ifd *tiffIFD) {
+		stripped = ifd.remove(tagGPSIFD) || stripped
+		for _, entry := range ifd.entries {
+			if entry.sub != nil {
+				strip(entry.sub)
+			}
+		}
+	}
+	for _, ifd := range t.ifds {
+		strip(ifd)
+	}
+	return stripped
+}
+
+// Removes the maker note from the EXIF IFDs of the TIFF structure.
+func stripMakerNote(t *tiff) {
+	for _, ifd := range t.ifds {
+		if exif := ifd.entry(tagExifIFD); exif != nil && exif.sub != nil {
+			exif.sub.remove(tagMakerNote)
+		}
+	}
+}
+
+// Redacts the dates of the TIFF structure: DateTime in its IFDs, DateTimeOriginal and DateTimeDigitized in their EXIF IFDs.
+func redactDates(t *tiff) {
+	for _, ifd := range t.ifds {
+		ifd.redactDates()
+		if exif := ifd.entry(tagExifIFD); exif != nil && exif.sub != nil {
+			exif.sub.redactDates()
+		}
+	}
+}
+
+// Redacts the date entries of the IFD, reporting whether there were any.
+func (ifd *tiffIFD) redactDates() bool {
+	redacted := false
+	for _, entry := range ifd.entries {
+		if entry.tag == tagDateTime || entry.tag == tagDateTimeOriginal || entry.tag == tagDateTimeDigitized {
+			entry.redactDate()
+			redacted = true
+		}
+	}
+	return redacted
+}
+
+// Overwrites the date of the entry with the placeholder the EXIF standard allows for unknown dates:
+// Everything but the colons (and the terminating null) is blanked, e.g. "    :  :     :  :  ".
+// This keeps the layout of the entry, unlike removing it.
+func (entry *tiffEntry) redactDate() {
+	value := make([]byte, len(entry.value))
+	for i, c := range entry.value {
+		if c == ':' || c == 0 {
+			value[i] = c
+		} else {
+			value[i] = ' '
+		}
+	}
+	entry.value = value
+}
+
+// Reduces the TIFF structure to an IFD0 containing at most the orientation (if orientation is true)
+// and, if thumbnail is true, IFD1 along with the thumbnail, or to nothing if neither is present.
+// Since IFD1 can't do without IFD0, and IFDs without entries are invalid, IFD0 then keeps
+// the resolution entries EXIF requires of it, or gets the default resolution unit if there are none.
+func keepOnly(t *tiff, orientation, thumbnail bool) {
+	if len(t.ifds) == 0 {
+		return
+	}
+	ifd0 := &tiffIFD{}
+	if entry := t.ifds[0].entry(tagOrientation); orientation && entry != nil {
+		ifd0.entries = append(ifd0.entries, entry)
+	}
+	if !thumbnail || len(t.ifds) < 2 || t.ifds[1].thumbnail == nil {
+		t.ifds = nil
+		if len(ifd0.entries) > 0 {
+			t.ifds = []*tiffIFD{ifd0}
+		}
+		return
+	}
+	for _, tag := range []uint16{tagXResolution, tagYResolution, tagResolutionUnit} {
+		if entry := t.ifds[0].entry(tag); entry != nil {
+			ifd0.entries = append(ifd0.entries, entry)
+		}
+	}
+	if len(ifd0.entries) == 0 {
+		unit := &tiffEntry{tag: tagResolutionUnit, typ: 3, count: 1, value: make([]byte, 2)}
+		t.order.PutUint16(unit.value, 2) // inches, which is what readers assume anyways
+		ifd0.entries = append(ifd0.entries, unit)
+	}
+	ifd1 := t.ifds[1]
+	for _, tag := range []uint16{tagExifIFD, tagGPSIFD, tagInteropIFD} {
+		ifd1.remove(tag)
+	}
+	t.ifds = []*tiffIFD{ifd0, ifd1}
+}
+
+// Wraps an EXIF payload, with or without the EXIF header, in a minimal JPEG consisting only of an APP1 segment,
+// so that it can serve as metadata source. TIFF files are valid EXIF payloads as well.
+func wrapEXIF(exif []byte) ([]byte, error) {
+	if !bytes.HasPrefix(exif, []byte(exifHeader)) {
+		exif = append([]byte(exifHeader), exif...)
+	}
+	_, err := parseTIFF(exif[len(exifHeader):])
+	if err != nil { return nil, err }
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	_, err = writer.Write([]byte{0xFF, SOI})
+	if err != nil { return nil, err }
+	err = writeSegment(writer, APP1, exif)
+	if err != nil { return nil, err }
+	_, err = writer.Write([]byte{0xFF, EOI})
+	if err != nil { return nil, err }
+	err = writer.Flush()
+	return buf.Bytes(), err
+}
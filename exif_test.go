@@ -0,0 +1,132 @@
+package scrubbish
+
+import (
+	"fmt"
+	"bytes"
+	"testing"
+	"encoding/binary"
+)
+
+// Returns a TIFF entry of type SHORT holding v.
+func shortEntry(order binary.ByteOrder, tag, v uint16) *tiffEntry {
+	entry := &tiffEntry{tag: tag, typ: 3, count: 1, value: make([]byte, 2)}
+	order.PutUint16(entry.value, v)
+	return entry
+}
+
+// Returns a TIFF entry of type LONG holding v.
+func longEntry(order binary.ByteOrder, tag uint16, v uint32) *tiffEntry {
+	entry := &tiffEntry{tag: tag, typ: 4, count: 1, value: make([]byte, 4)}
+	order.PutUint32(entry.value, v)
+	return entry
+}
+
+// Returns an EXIF segment holding the IFD0 entries and, if thumbnail is not nil, IFD1 with the thumbnail.
+func exifThumbnailSegment(order binary.ByteOrder, ifd0 []*tiffEntry, thumbnail []byte) []byte {
+	t := &tiff{order: order, ifds: []*tiffIFD{{entries: ifd0}}}
+	if thumbnail != nil {
+		t.ifds = append(t.ifds, &tiffIFD{entries: []*tiffEntry{
+			shortEntry(order, 0x0103, 6), // JPEG compression
+			longEntry(order, tagThumbnailOffset, 0),
+			longEntry(order, tagThumbnailLength, 0),
+		}, thumbnail: thumbnail})
+	}
+	return jpegSegment(APP1, append([]byte(exifHeader), t.bytes()...))
+}
+
+// Strips the image with the EXIF segment under the options, returning the parsed EXIF segments of the output.
+func strippedEXIF(t *testing.T, exif []byte, opts ...Option) []*tiff {
+	t.Helper()
+	image := testJPEG{ecsLength: 100}.bytes()
+	stripped, err := StripBytes(withSegments(image, exif, commentSegment("comment")), opts...)
+	if err != nil { t.Fatal(err) }
+	var exifs []*tiff
+	for _, seg := range walkSegments(t, stripped, APP1) {
+		parsed, err := parseTIFF(seg.Payload[len(exifHeader):])
+		if err != nil { t.Fatal(err) }
+		exifs = append(exifs, parsed)
+	}
+	return exifs
+}
+
+func TestKeepThumbnail(t *testing.T) {
+	thumbnail := testJPEG{ecsLength: 20}.bytes()
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		model := &tiffEntry{tag: 0x0110, typ: 2, count: 7, value: []byte("Camera\x00")}
+		resolution := &tiffEntry{tag: tagXResolution, typ: 5, count: 1, value: rationalValue(order, 72, 1)}
+		for _, test := range []struct {
+			name string
+			ifd0 []*tiffEntry
+			want []uint16 // tags of IFD0 after stripping
+		}{
+			{"resolution", []*tiffEntry{model, resolution, shortEntry(order, tagResolutionUnit, 2), shortEntry(order, tagOrientation, 6)}, []uint16{tagXResolution, tagResolutionUnit}},
+			{"no resolution", []*tiffEntry{model}, []uint16{tagResolutionUnit}},
+		} {
+			exifs := strippedEXIF(t, exifThumbnailSegment(order, test.ifd0, thumbnail), WithKeepThumbnail())
+			if len(exifs) != 1 || len(exifs[0].ifds) != 2 {
+				t.Fatalf("%s: got %d EXIF segments, want one with IFD0 and IFD1", test.name, len(exifs))
+			}
+			var tags []uint16
+			for _, entry := range exifs[0].ifds[0].entries {
+				tags = append(tags, entry.tag)
+			}
+			if fmt.Sprint(tags) != fmt.Sprint(test.want) {
+				t.Errorf("%s: IFD0 holds tags %X, want %X", test.name, tags, test.want)
+			}
+			if !bytes.Equal(exifs[0].ifds[1].thumbnail, thumbnail) {
+				t.Errorf("%s: thumbnail not kept", test.name)
+			}
+		}
+		// Without a thumbnail, nothing is left to keep
+		if exifs := strippedEXIF(t, exifThumbnailSegment(order, []*tiffEntry{model, resolution}, nil), WithKeepThumbnail()); len(exifs) != 0 {
+			t.Errorf("EXIF segment without thumbnail kept")
+		}
+		// Only the orientation is kept if there is no thumbnail to keep
+		exifs := strippedEXIF(t, exifThumbnailSegment(order, []*tiffEntry{model, resolution, shortEntry(order, tagOrientation, 6)}, nil), WithKeepThumbnail(), WithKeepOrientation())
+		if len(exifs) != 1 || len(exifs[0].ifds) != 1 || len(exifs[0].ifds[0].entries) != 1 || exifs[0].ifds[0].entries[0].tag != tagOrientation {
+			t.Errorf("want an EXIF segment holding only the orientation")
+		}
+	}
+}
+
+// Returns the value of a TIFF entry of type RATIONAL.
+func rationalValue(order binary.ByteOrder, numerator, denominator uint32) []byte {
+	value := make([]byte, 8)
+	order.PutUint32(value, numerator)
+	order.PutUint32(value[4:], denominator)
+	return value
+}
+
+func TestInspectMalformedEXIF(t *testing.T) {
+	image := testJPEG{ecsLength: 100}.bytes()
+	malformed := jpegSegment(APP1, append([]byte(exifHeader), "MM\x00\x2a\xff\xff\xff\xff"...))
+	for _, test := range []struct {
+		name string
+		exif []byte
+		gps bool
+		errors int
+	}{
+		{"GPS", exifSegment(binary.LittleEndian), true, 0},
+		{"no GPS", exifThumbnailSegment(binary.BigEndian, []*tiffEntry{shortEntry(binary.BigEndian, tagOrientation, 6)}, nil), false, 0},
+		{"malformed", malformed, false, 1},
+	} {
+		input := withSegments(image, test.exif, commentSegment("comment"))
+		inventory, err := Inspect(bytes.NewReader(input))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !inventory.EXIF || !inventory.Comments || inventory.GPS != test.gps || len(inventory.Errors) != test.errors {
+			t.Errorf("%s: got %+v", test.name, inventory)
+		}
+		if test.errors > 0 && inventory.Errors[0].Offset != 2 {
+			t.Errorf("%s: error %v, want it at offset 2", test.name, inventory.Errors[0])
+		}
+	}
+	// Inspecting doesn't modify the EXIF, even when GPS stripping is requested
+	inventory, err := Inspect(bytes.NewReader(withSegments(image, exifSegment(binary.BigEndian))), WithStripGPS())
+	if err != nil { t.Fatal(err) }
+	if !inventory.GPS || inventory.MetadataBytes != int64(len(exifSegment(binary.BigEndian)) - 2) {
+		t.Errorf("got %+v", inventory)
+	}
+}
@@ -0,0 +1,36 @@
+package scrubbish
+
+import (
+	"io"
+	"context"
+	"bufio"
+)
+
+// Extract writes the metadata segments of the JPEG read from r to w, concatenated without SOI or EOI,
+// e.g. to archive metadata before stripping it.
+// The options selecting metadata (such as WithKeep, WithStrip, WithKeepXMP and WithFilter) are honored;
+// the segments are written unmodified, except for compressed comments under WithInflateComments.
+func Extract(w io.Writer, r io.Reader, opts ...Option) error {
+	o := newOptions(opts)
+	o.stripGPS, o.stripMakerNote, o.redactDates = false, false, false
+	writer := bufio.NewWriter(w)
+	walker := &segmentWalker{ctx: context.Background(), src: bufio.NewReader(r), opts: o, fromMetadata: true}
+	if !o.inflateComments {
+		err := walker.copySegments(writer, o.isMetadataSegment, nil)
+		if err != nil { return err }
+		return writer.Flush()
+	}
+	// Read the comments rather than copying them, to write them inflated
+	walker.readPayloads = true
+	err := walker.copySegments(writer, func(seg *segment) bool {
+		return seg.marker != COM && o.isMetadataSegment(seg)
+	}, func(seg segment) error {
+		if seg.marker != COM || !o.isMetadataSegment(&seg) {
+			return nil
+		}
+		comment, _ := inflateComment(seg.payload)
+		return writeCommentSegments(writer, comment, nil)
+	})
+	if err != nil { return err }
+	return writer.Flush()
+}
@@ -0,0 +1,130 @@
+package scrubbish
+
+import (
+	"io"
+	"bufio"
+	"errors"
+	"fmt"
+)
+
+// Format is an image format supported by scrubbish.
+type Format int
+
+const (
+	JPEG Format = iota + 1
+	PNG
+	WebP
+	TIFF
+)
+
+func (f Format) String() string {
+	switch f {
+		case JPEG:
+			return "JPEG"
+		case PNG:
+			return "PNG"
+		case WebP:
+			return "WebP"
+		case TIFF:
+			return "TIFF"
+	}
+	return "unknown"
+}
+
+// Number of bytes needed to detect the format of a file
+const formatHeaderLength = webpHeaderLength
+
+// ErrUnknownFormat is returned if an image is neither a JPEG, PNG, WebP nor TIFF.
+var ErrUnknownFormat = errors.New("unknown image format (not a JPEG, PNG, WebP or TIFF)")
+
+// Well-known unsupported formats, by their magic at the given offset, to name them in errors
+var otherFormats = []struct {
+	offset int
+	magic string
+	name string
+}{
+	{4, "ftyp", "an ISO media file (e.g. MP4 or MOV)"},
+	{0, "PK\x03\x04", "a ZIP archive"},
+	{0, "%PDF", "a PDF document"},
+	{0, "GIF8", "a GIF image"},
+	{0, "\x1F\x8B", "a gzip file"},
+	{0, "\x1A\x45\xDF\xA3", "a Matroska or WebM file"},
+	{0, "RIFF", "a RIFF file (e.g. AVI or WAV)"},
+}
+
+// Describes the format of a file starting with head, e.g. "a PNG image" or "a ZIP archive",
+// or returns "" if it is unknown.
+func describeFormat(head []byte) string {
+	if format := detectFormat(head); format != 0 {
+		return "a " + format.String() + " image"
+	}
+	if isHEIF(head) {
+		return "a HEIF image"
+	}
+	for _, other := range otherFormats {
+		end := other.offset + len(other.magic)
+		if len(head) >= end && string(head[other.offset:end]) == other.magic {
+			return other.name
+		}
+	}
+	return ""
+}
+
+// Returns ErrUnknownFormat for the file at path (which may be empty) starting with head,
+// naming its format if it is well-known, so that passing the wrong kind of file is told apart from a corrupt image.
+func unknownFormat(head []byte, path string) error {
+	msg := path
+	if name := describeFormat(head); name != "" {
+		if msg != "" {
+			msg += " is "
+		}
+		msg += name
+	}
+	if msg == "" {
+		return ErrUnknownFormat
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownFormat, msg)
+}
+
+// Returns the format of a file starting with head, or 0 if it is unknown.
+func detectFormat(head []byte) Format {
+	switch {
+		case len(head) >= 2 && head[0] == 0xFF && head[1] == SOI:
+			return JPEG
+		case isPNG(head):
+			return PNG
+		case isWebP(head):
+			return WebP
+		case isTIFF(head):
+			return TIFF
+	}
+	return 0
+}
+
+// DetectFormat detects the format of the image read from r by its first bytes,
+// returning ErrUnknownFormat if it isn't supported.
+// If r is a *bufio.Reader, the bytes are only peeked at; otherwise, they are consumed.
+func DetectFormat(r io.Reader) (Format, error) {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReaderSize(r, formatHeaderLength)
+	}
+	head, err := reader.Peek(formatHeaderLength)
+	if err != nil && err != io.EOF { return 0, err }
+	format := detectFormat(head)
+	if format == 0 {
+		return 0, unknownFormat(head, "")
+	}
+	return format, nil
+}
+
+// Reads exactly n bytes from r. Unlike io.ReadFull into a buffer of n bytes, this only allocates memory
+// as the data arrives, so that huge lengths declared by malformed input don't cause huge allocations.
+func readN(r io.Reader, n int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, n))
+	if err != nil { return nil, err }
+	if int64(len(data)) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
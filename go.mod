@@ -1,3 +1,5 @@
 module github.com/appgurueu/scrubbish
 
 go 1.20
+
+require golang.org/x/sys v0.30.0
@@ -0,0 +1,259 @@
+package scrubbish
+
+import (
+	"io"
+	"context"
+	"bufio"
+	"bytes"
+	"fmt"
+	"encoding/binary"
+)
+
+// HEIF files (HEIC photos, AVIF) are ISO base media files: sequences of boxes, each consisting of
+// the big-endian size of the box, a type, and the payload, which may hold further boxes.
+// Metadata such as EXIF and XMP is stored as items: The meta box lists them in its iinf box
+// and locates their data in its iloc box, either in the file (usually the mdat box) or in its idat box.
+// HEIF files are only supported as metadata sources; only the EXIF and XMP items are read.
+
+// Reports whether head, the first bytes of a file, is the header of a HEIF file.
+func isHEIF(head []byte) bool {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(head[8:12]) {
+		case "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1", "avif", "avis":
+			return true
+	}
+	return false
+}
+
+type heifBox struct {
+	typ string
+	offset int64 // of the box header
+	payload []byte
+}
+
+// Splits data, which starts at the given offset of the file, into boxes.
+func heifBoxes(data []byte, offset int64) ([]heifBox, error) {
+	var boxes []heifBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, &ParseError{Offset: offset, Kind: "truncated box header"}
+		}
+		size, headerLength := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		typ := string(data[4:8])
+		switch size {
+			case 0: // the box extends to the end
+				size = uint64(len(data))
+			case 1:
+				if len(data) < 16 {
+					return nil, &ParseError{Offset: offset, Kind: "truncated box header"}
+				}
+				size, headerLength = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < headerLength || size > uint64(len(data)) {
+			return nil, &ParseError{Offset: offset, Kind: "invalid box size", Msg: fmt.Sprintf("%d of %q", size, typ)}
+		}
+		boxes = append(boxes, heifBox{typ: typ, offset: offset, payload: data[headerLength:size]})
+		data = data[size:]
+		offset += int64(size)
+	}
+	return boxes, nil
+}
+
+// Returns the first box of the given type, or nil.
+func findHEIFBox(boxes []heifBox, typ string) *heifBox {
+	for i := range boxes {
+		if boxes[i].typ == typ {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// heifReader reads the big-endian fields of a box, remembering whether it ran out of data.
+type heifReader struct {
+	data []byte
+	short bool
+}
+
+// Reads an unsigned integer of 0, 2, 4 or 8 bytes.
+func (r *heifReader) uint(size int) uint64 {
+	if len(r.data) < size {
+		r.short = true
+		return 0
+	}
+	var value uint64
+	for _, b := range r.data[:size] {
+		value = value << 8 | uint64(b)
+	}
+	r.data = r.data[size:]
+	return value
+}
+
+// Reads a null-terminated string.
+func (r *heifReader) string() string {
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		r.short = true
+		return ""
+	}
+	s := string(r.data[:i])
+	r.data = r.data[i + 1:]
+	return s
+}
+
+// Reads the EXIF and XMP items of a HEIF file, returning their payloads along with the equivalent JPEG segments.
+func readHEIF(data []byte) ([]rawMetadata, error) {
+	boxes, err := heifBoxes(data, 0)
+	if err != nil { return nil, err }
+	meta := findHEIFBox(boxes, "meta")
+	if meta == nil {
+		return nil, nil
+	}
+	// meta is a full box: version and flags precede the child boxes
+	if len(meta.payload) < 4 {
+		return nil, &ParseError{Offset: meta.offset, Kind: "truncated meta box"}
+	}
+	children, err := heifBoxes(meta.payload[4:], meta.offset + 12)
+	if err != nil { return nil, err }
+	iinf, iloc := findHEIFBox(children, "iinf"), findHEIFBox(children, "iloc")
+	if iinf == nil || iloc == nil {
+		return nil, nil
+	}
+
+	// Find the metadata items
+	types := map[uint64]string{}
+	r := &heifReader{data: iinf.payload}
+	version := r.uint(4) >> 24
+	if version == 0 {
+		r.uint(2) // entry count
+	} else {
+		r.uint(4)
+	}
+	if r.short {
+		return nil, &ParseError{Offset: iinf.offset, Kind: "truncated iinf box"}
+	}
+	infes, err := heifBoxes(r.data, iinf.offset + int64(len(iinf.payload) - len(r.data)) + 8)
+	if err != nil { return nil, err }
+	for _, infe := range infes {
+		if infe.typ != "infe" {
+			continue
+		}
+		r := &heifReader{data: infe.payload}
+		version := r.uint(4) >> 24
+		if version < 2 {
+			continue // item types were only introduced with version 2
+		}
+		idSize := 2
+		if version >= 3 {
+			idSize = 4
+		}
+		id := r.uint(idSize)
+		r.uint(2) // protection index
+		var typ string
+		if len(r.data) >= 4 {
+			typ = string(r.data[:4])
+		}
+		r.uint(4)
+		if typ == "mime" {
+			r.string() // item name
+			if r.string() == "application/rdf+xml" {
+				typ = "XMP"
+			}
+		}
+		if r.short {
+			return nil, &ParseError{Offset: infe.offset, Kind: "truncated infe box"}
+		}
+		if typ == "Exif" || typ == "XMP" {
+			types[id] = typ
+		}
+	}
+	if len(types) == 0 {
+		return nil, nil
+	}
+
+	var idat []byte
+	if box := findHEIFBox(children, "idat"); box != nil {
+		idat = box.payload
+	}
+	var raw []rawMetadata
+	r = &heifReader{data: iloc.payload}
+	version = r.uint(4) >> 24
+	sizes := r.uint(2)
+	offsetSize, lengthSize, baseOffsetSize, indexSize := int(sizes >> 12), int(sizes >> 8 & 0xF), int(sizes >> 4 & 0xF), int(sizes & 0xF)
+	if version == 0 {
+		indexSize = 0
+	}
+	idSize := 2
+	if version >= 2 {
+		idSize = 4
+	}
+	count := r.uint(idSize)
+	for i := uint64(0); i < count && !r.short; i++ {
+		id := r.uint(idSize)
+		constructionMethod := uint64(0)
+		if version >= 1 {
+			constructionMethod = r.uint(2) & 0xF
+		}
+		r.uint(2) // data reference index
+		baseOffset := r.uint(baseOffsetSize)
+		extents := r.uint(2)
+		typ, wanted := types[id]
+		source := data
+		if constructionMethod == 1 {
+			source = idat
+		} else if constructionMethod != 0 && wanted {
+			return nil, &ParseError{Offset: iloc.offset, Kind: "unsupported item construction method", Msg: fmt.Sprint(constructionMethod)}
+		}
+		var payload []byte
+		var offset int64
+		for j := uint64(0); j < extents && !r.short; j++ {
+			r.uint(indexSize)
+			extentOffset, extentLength := baseOffset + r.uint(offsetSize), r.uint(lengthSize)
+			if !wanted {
+				continue
+			}
+			if extentOffset > uint64(len(source)) {
+				return nil, &ParseError{Offset: iloc.offset, Kind: "item extent out of bounds", Msg: fmt.Sprintf("of item %d", id)}
+			}
+			if extentLength == 0 {
+				extentLength = uint64(len(source)) - extentOffset // the extent extends to the end
+			}
+			if extentLength > uint64(len(source)) - extentOffset {
+				return nil, &ParseError{Offset: iloc.offset, Kind: "item extent out of bounds", Msg: fmt.Sprintf("of item %d", id)}
+			}
+			if j == 0 {
+				offset = int64(extentOffset)
+			}
+			payload = append(payload, source[extentOffset:extentOffset + extentLength]...)
+		}
+		if r.short || !wanted {
+			continue
+		}
+		seg := segment{offset: offset, length: len(payload), name: typ + " item", marker: APP1, ident: "EXIF"}
+		if typ == "Exif" {
+			// The TIFF structure is preceded by its offset, which skips an optional EXIF header
+			if len(payload) < 4 || uint64(binary.BigEndian.Uint32(payload)) > uint64(len(payload) - 4) {
+				return nil, &ParseError{Offset: offset, Kind: "invalid Exif item"}
+			}
+			payload = payload[4 + binary.BigEndian.Uint32(payload):]
+		} else {
+			seg.ident = "XMP"
+		}
+		raw = append(raw, rawMetadata{seg: seg, isMetadata: true, payload: payload})
+	}
+	if r.short {
+		return nil, &ParseError{Offset: iloc.offset, Kind: "truncated iloc box"}
+	}
+	return raw, nil
+}
+
+// Like readMetadataItems, but for HEIF metadata sources, which are read into memory as a whole.
+func readHEIFMetadataItems(ctx context.Context, metadata *bufio.Reader, o *options) ([]metadataItem, error) {
+	data, err := io.ReadAll(metadata)
+	if err != nil { return nil, err }
+	raw, err := readHEIF(data)
+	if err != nil { return nil, err }
+	return rawMetadataItems(ctx, raw, o)
+}
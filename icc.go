@@ -0,0 +1,73 @@
+package scrubbish
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// ICC profiles too large for a single APP2 segment are split into chunks.
+// Each chunk starts with "ICC_PROFILE\0" followed by its one-based sequence number and the total number of chunks.
+
+const iccHeaderLength = len("ICC_PROFILE\x00") + 2
+
+// iccChecker checks that the ICC profile chunks copied from a JPEG are complete and in order.
+type iccChecker struct {
+	count byte // total number of chunks as declared by the first chunk; 0 if none has been seen yet
+	seen byte // number of chunks seen so far
+	offset int64 // of the first chunk
+}
+
+// Checks the next chunk, given the head of the payload of its segment.
+func (c *iccChecker) chunk(seg *segment, head []byte) error {
+	if len(head) < iccHeaderLength {
+		return &ParseError{Offset: seg.offset, Kind: "truncated ICC profile chunk header"}
+	}
+	seq, count := head[iccHeaderLength - 2], head[iccHeaderLength - 1]
+	if count == 0 {
+		return &ParseError{Offset: seg.offset, Kind: "invalid ICC profile chunk count", Msg: "0"}
+	}
+	if c.count == 0 {
+		c.count, c.offset = count, seg.offset
+	} else if count != c.count {
+		return &ParseError{Offset: seg.offset, Kind: "invalid ICC profile chunk count",
+			Msg: fmt.Sprintf("%d (expected %d)", count, c.count)}
+	}
+	if seq > c.count {
+		return &ParseError{Offset: seg.offset, Kind: "invalid ICC profile chunk",
+			Msg: fmt.Sprintf("%d (beyond the %d declared)", seq, c.count)}
+	}
+	if seq != c.seen + 1 {
+		return &ParseError{Offset: seg.offset, Kind: "invalid ICC profile chunk",
+			Msg: fmt.Sprintf("%d (expected %d of %d)", seq, c.seen + 1, c.count)}
+	}
+	c.seen++
+	return nil
+}
+
+// Checks that all chunks have been seen.
+func (c *iccChecker) done() error {
+	if c.seen < c.count {
+		return &ParseError{Offset: c.offset, Kind: "incomplete ICC profile",
+			Msg: fmt.Sprintf("(%d of %d chunks)", c.seen, c.count)}
+	}
+	return nil
+}
+
+// Writes an ICC profile as APP2 segments, splitting it into as many chunks as needed.
+func writeICCSegments(dst *bufio.Writer, profile []byte) error {
+	const chunkLength = maxPayloadLength - iccHeaderLength
+	count := (len(profile) + chunkLength - 1) / chunkLength
+	if count > 255 {
+		return fmt.Errorf("ICC profile too large: %d bytes", len(profile))
+	}
+	for seq := 1; seq <= count; seq++ {
+		chunk := profile[(seq - 1)*chunkLength:]
+		if len(chunk) > chunkLength {
+			chunk = chunk[:chunkLength]
+		}
+		payload := append([]byte("ICC_PROFILE\x00"), byte(seq), byte(count))
+		err := writeSegment(dst, APP2, append(payload, chunk...))
+		if err != nil { return err }
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package scrubbish
+
+import (
+	"io"
+	"bytes"
+)
+
+// Inventory describes the metadata of an image, as reported by Inspect.
+type Inventory struct {
+	Format Format
+	EXIF bool
+	GPS bool // whether the EXIF holds GPS information
+	XMP bool
+	IPTC bool
+	ICC bool
+	Comments bool // COM segments or, for PNGs, text and tIME chunks
+	MetadataBytes int64 // total length of the metadata segments or chunks
+	Errors []*ParseError // of metadata segments which couldn't be parsed, such as malformed EXIF; these don't fail Inspect
+}
+
+// Inspect reports the metadata of the image read from r, that is, what stripping it would remove, without writing anything.
+// The options selecting metadata (such as WithKeep, WithStrip, WithKeepXMP and WithFilter) are honored; trailing data is ignored.
+func Inspect(r io.Reader, opts ...Option) (*Inventory, error) {
+	return inspect(r, newOptions(opts))
+}
+
+func inspect(r io.Reader, selection *options) (*Inventory, error) {
+	inventory := &Inventory{}
+	observe := func(seg *segment, fromMetadata, kept bool) {
+		if !selection.isMetadataSegment(seg) {
+			return
+		}
+		inventory.MetadataBytes += int64(seg.length)
+		switch {
+			case seg.marker == APP1 && seg.ident == "EXIF":
+				inventory.EXIF = true
+			case seg.marker == APP1 && seg.ident == "XMP":
+				inventory.XMP = true
+			case seg.marker == APP2 && seg.ident == "ICC":
+				inventory.ICC = true
+			case seg.marker == APP13:
+				inventory.IPTC = true
+			case seg.marker == COM:
+				inventory.Comments = true
+		}
+	}
+	image := selection.newReader(r)
+	format, err := DetectFormat(image)
+	if err != nil { return nil, err }
+	inventory.Format = format
+	// EXIF segments are parsed to find GPS information; everything else is merely observed
+	err = Merge(io.Discard, image, nil, func(o *options) {
+		*o = options{
+			keep: selection.keep,
+			strip: selection.strip,
+			keepXMP: selection.keepXMP,
+			stripXMP: selection.stripXMP,
+			filter: selection.filter,
+			filterPayloads: selection.filterPayloads,
+			bufferSize: selection.bufferSize,
+			maxFileSize: selection.maxFileSize,
+			keepTrailer: true,
+			inventory: inventory,
+			observe: observe,
+		}
+	})
+	if err != nil { return nil, err }
+	return inventory, nil
+}
+
+// Notes whether the payload of an EXIF segment holds GPS information, without modifying it.
+// Malformed EXIF is recorded in the errors of the inventory.
+func (inventory *Inventory) inspectEXIF(seg *segment, payload []byte) {
+	var t *tiff
+	err := errTIFF
+	if bytes.HasPrefix(payload, []byte(exifHeader)) {
+		t, err = parseTIFF(payload[len(exifHeader):])
+	}
+	if err != nil {
+		inventory.Errors = append(inventory.Errors, &ParseError{Offset: seg.offset, Kind: "invalid TIFF structure", Msg: "(in EXIF)"})
+		return
+	}
+	var hasGPS func(ifd *tiffIFD) bool
+	hasGPS = func(ifd *tiffIFD) bool {
+		for _, entry := range ifd.entries {
+			if entry.tag == tagGPSIFD || entry.sub != nil && hasGPS(entry.sub) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, ifd := range t.ifds {
+		inventory.GPS = inventory.GPS || hasGPS(ifd)
+	}
+}
@@ -0,0 +1,85 @@
+package scrubbish
+
+import (
+	"io"
+	"context"
+	"bufio"
+	"fmt"
+	"encoding/json"
+)
+
+// List writes a listing of the segments of the JPEG read from r to w.
+// Each segment gets a line "offset marker length", e.g. "0x0002 APP0(JFIF) 16" (see MarkerName);
+// the entropy-coded data following SOS and any trailing data after EOI are listed as "ECS" and "trailer".
+// Under WithInflateComments, the lines of COM segments additionally hold the quoted comment,
+// followed by "(inflated)" if it was zlib-compressed.
+// List only reads r; the only option it honors is WithInflateComments.
+func List(w io.Writer, r io.Reader, opts ...Option) error {
+	o := newOptions(opts)
+	walker := &segmentWalker{ctx: context.Background(), src: bufio.NewReader(r), opts: &options{stripTrailer: true}, readPayloads: o.inflateComments}
+	err := walker.copySegments(nil, func(*segment) bool { return false }, func(seg segment) error {
+		name := MarkerName(seg.marker)
+		if seg.ident != "" {
+			name += "(" + seg.ident + ")"
+		}
+		if seg.length == 0 {
+			_, err := fmt.Fprintf(w, "0x%04X %s\n", seg.offset, name)
+			return err
+		}
+		if seg.marker == COM && o.inflateComments {
+			comment, inflated := inflateComment(seg.payload)
+			suffix := ""
+			if inflated {
+				suffix = " (inflated)"
+			}
+			_, err := fmt.Fprintf(w, "0x%04X %s %d %q%s\n", seg.offset, name, seg.length, comment, suffix)
+			return err
+		}
+		_, err := fmt.Fprintf(w, "0x%04X %s %d\n", seg.offset, name, seg.length)
+		if err != nil { return err }
+		if seg.marker == SOS {
+			_, err = fmt.Fprintf(w, "0x%04X ECS %d\n", seg.offset + int64(seg.length) + 2, seg.ecsLength)
+		}
+		return err
+	})
+	if err != nil { return err }
+	trailerLength, err := io.Copy(io.Discard, walker.src)
+	if err != nil { return err }
+	if trailerLength > 0 {
+		_, err = fmt.Fprintf(w, "0x%04X trailer %d\n", walker.offset, trailerLength)
+	}
+	return err
+}
+
+type jsonSegment struct {
+	Marker string `json:"marker"`
+	Hex string `json:"hex"`
+	Identifier string `json:"identifier,omitempty"`
+	Offset int64 `json:"offset"`
+	Length int `json:"length"`
+	ECSLength int64 `json:"ecsLength,omitempty"`
+	IsMetadata bool `json:"isMetadata"`
+}
+
+// ListJSON writes the segments of the JPEG read from r to w as a JSON array of objects like
+// {"marker":"APP1","hex":"0xE1","offset":20,"length":4521,"isMetadata":true}.
+// SOS segments additionally carry the length of the following entropy-coded data as "ecsLength".
+// ListJSON only reads r; trailing data is ignored.
+func ListJSON(w io.Writer, r io.Reader) error {
+	walker := &segmentWalker{ctx: context.Background(), src: bufio.NewReader(r), opts: &options{stripTrailer: true}}
+	segments := []jsonSegment{}
+	err := walker.copySegments(nil, func(*segment) bool { return false }, func(seg segment) error {
+		segments = append(segments, jsonSegment{
+			Marker: markerName(seg.marker),
+			Hex: fmt.Sprintf("0x%02X", seg.marker),
+			Identifier: seg.ident,
+			Offset: seg.offset,
+			Length: seg.length,
+			ECSLength: seg.ecsLength,
+			IsMetadata: walker.opts.isMetadataSegment(&seg),
+		})
+		return nil
+	})
+	if err != nil { return err }
+	return json.NewEncoder(w).Encode(segments)
+}
@@ -0,0 +1,185 @@
+package scrubbish
+
+import (
+	"fmt"
+	"strings"
+	"strconv"
+)
+
+// Markers of JPEG segments, the byte following 0xFF
+const (
+	TEM = 0x01
+	SOF0 = 0xC0 // baseline
+	SOF1 = 0xC1
+	SOF2 = 0xC2 // progressive
+	SOF3 = 0xC3
+	DHT = 0xC4
+	SOF5 = 0xC5
+	SOF6 = 0xC6
+	SOF7 = 0xC7
+	JPG = 0xC8
+	SOF9 = 0xC9
+	SOF10 = 0xCA
+	SOF11 = 0xCB
+	DAC = 0xCC
+	SOF13 = 0xCD
+	SOF14 = 0xCE
+	SOF15 = 0xCF
+	RST0 = 0xD0
+	RST1 = 0xD1
+	RST2 = 0xD2
+	RST3 = 0xD3
+	RST4 = 0xD4
+	RST5 = 0xD5
+	RST6 = 0xD6
+	RST7 = 0xD7
+	SOI = 0xD8
+	EOI = 0xD9
+	SOS = 0xDA
+	DQT = 0xDB
+	DNL = 0xDC
+	DRI = 0xDD
+	DHP = 0xDE
+	EXP = 0xDF
+	APP0 = 0xE0 // typically JFIF
+	APP1 = 0xE1 // typically EXIF or XMP
+	APP2 = 0xE2 // typically ICC profiles
+	APP3 = 0xE3
+	APP4 = 0xE4
+	APP5 = 0xE5
+	APP6 = 0xE6
+	APP7 = 0xE7
+	APP8 = 0xE8
+	APP9 = 0xE9
+	APP10 = 0xEA
+	APP11 = 0xEB
+	APP12 = 0xEC // typically Ducky
+	APP13 = 0xED // typically IPTC
+	APP14 = 0xEE // typically Adobe
+	APP15 = 0xEF
+	COM = 0xFE
+)
+
+// Coding processes of the SOFn markers
+var sofProcesses = map[byte]string{
+	SOF0: "baseline",
+	SOF1: "extended sequential",
+	SOF2: "progressive",
+	SOF3: "lossless",
+	SOF5: "differential sequential",
+	SOF6: "differential progressive",
+	SOF7: "differential lossless",
+	SOF9: "extended sequential, arithmetic",
+	SOF10: "progressive, arithmetic",
+	SOF11: "lossless, arithmetic",
+	SOF13: "differential sequential, arithmetic",
+	SOF14: "differential progressive, arithmetic",
+	SOF15: "differential lossless, arithmetic",
+}
+
+// MarkerName returns a human-readable name for the marker, e.g. "APP1", "DQT" or "SOF0 (baseline)".
+// Start of frame markers are followed by their coding process.
+func MarkerName(marker byte) string {
+	if process, ok := sofProcesses[marker]; ok {
+		return fmt.Sprintf("%s (%s)", markerName(marker), process)
+	}
+	return markerName(marker)
+}
+
+// Returns a short name for the marker, e.g. "APP1" or "SOF2".
+func markerName(marker byte) string {
+	switch {
+		case marker == TEM:
+			return "TEM"
+		case marker == DHT:
+			return "DHT"
+		case marker == JPG:
+			return "JPG"
+		case marker == DAC:
+			return "DAC"
+		case marker >= SOF0 && marker <= SOF15:
+			return fmt.Sprintf("SOF%d", marker - SOF0)
+		case isRestart(marker):
+			return fmt.Sprintf("RST%d", marker - RST0)
+		case marker == SOI:
+			return "SOI"
+		case marker == EOI:
+			return "EOI"
+		case marker == SOS:
+			return "SOS"
+		case marker == DQT:
+			return "DQT"
+		case marker == DNL:
+			return "DNL"
+		case marker == DRI:
+			return "DRI"
+		case marker == DHP:
+			return "DHP"
+		case marker == EXP:
+			return "EXP"
+		case marker >= APP0 && marker <= APP15:
+			return fmt.Sprintf("APP%d", marker - APP0)
+		case marker == COM:
+			return "COM"
+	}
+	return fmt.Sprintf("0x%02X", marker)
+}
+
+// Common names of the kinds of metadata stored in APPn segments, mapped to their markers.
+var markerAliases = map[string]byte{
+	"JFIF": APP0,
+	"EXIF": APP1,
+	"ICC": APP2,
+	"DUCKY": APP12,
+	"IPTC": APP13,
+	"ADOBE": APP14,
+}
+
+// ParseMarker parses a marker given either by name (as in "APP2" or "COM", case-insensitive),
+// by the kind of metadata it typically holds (as in "ICC" for APP2, or "EXIF", "IPTC", "Ducky", "JFIF", "Adobe"),
+// or as a hex byte (as in "0xE2").
+func ParseMarker(name string) (byte, error) {
+	if marker, ok := markerAliases[strings.ToUpper(name)]; ok {
+		return marker, nil
+	}
+	if strings.HasPrefix(name, "0x") || strings.HasPrefix(name, "0X") {
+		marker, err := strconv.ParseUint(name[2:], 16, 8)
+		if err != nil {
+			return 0, fmt.Errorf("invalid marker: %s", name)
+		}
+		return byte(marker), nil
+	}
+	for marker := 0; marker <= 0xFF; marker++ {
+		if strings.EqualFold(markerName(byte(marker)), name) {
+			return byte(marker), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown marker: %s", name)
+}
+
+// Identifiers at the start of APPn payloads, which tell what the payload contains.
+var appIdentifiers = []struct{ prefix, name string }{
+	{"JFIF\x00", "JFIF"},
+	{"JFXX\x00", "JFXX"},
+	{"Exif\x00", "EXIF"},
+	{"http://ns.adobe.com/xap/1.0/\x00", "XMP"},
+	{"http://ns.adobe.com/xmp/extension/\x00", "XMP"},
+	{"ICC_PROFILE\x00", "ICC"},
+	{"MPF\x00", "MPF"},
+	{"Photoshop 3.0\x00", "IPTC"},
+	{"Adobe", "Adobe"},
+	{"Ducky", "Ducky"},
+}
+
+// Length of the longest identifier in appIdentifiers.
+const maxIdentLength = len("http://ns.adobe.com/xmp/extension/\x00")
+
+// Returns the name of the identifier the APPn payload starts with, or "" if it is unknown.
+func appIdentifier(payload []byte) string {
+	for _, ident := range appIdentifiers {
+		if strings.HasPrefix(string(payload), ident.prefix) {
+			return ident.name
+		}
+	}
+	return ""
+}
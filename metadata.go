@@ -0,0 +1,188 @@
+package scrubbish
+
+import (
+	"context"
+	"bufio"
+	"bytes"
+)
+
+// metadataItem is a piece of metadata read from a metadata source in a format-neutral representation,
+// so that metadata can be copied to images of other formats.
+type metadataItem struct {
+	seg segment // the segment or chunk the item was read from, for the observer
+	kind string // "EXIF", "XMP", "ICC", "COM", or "" if the item has no equivalent in other formats
+	data []byte // the TIFF structure, the XMP packet, the ICC profile or the comment text
+}
+
+// Identifier of standard XMP packets in APP1 segments
+const xmpHeader = "http://ns.adobe.com/xap/1.0/\x00"
+
+// Reads the metadata to be copied from a JPEG, WebP or HEIF metadata source, in order,
+// rewriting EXIF where the options call for it (dropping it if nothing remains).
+// The segments which aren't metadata are reported to the observer of the options as not added.
+func readMetadataItems(ctx context.Context, metadata *bufio.Reader, o *options) ([]metadataItem, error) {
+	head, _ := metadata.Peek(webpHeaderLength)
+	if isWebP(head) {
+		return readWebPMetadataItems(ctx, metadata, o)
+	}
+	if isHEIF(head) {
+		return readHEIFMetadataItems(ctx, metadata, o)
+	}
+	var items []metadataItem
+	var icc *metadataItem
+	var copied int64
+	walker := &segmentWalker{ctx: ctx, src: metadata, opts: &options{}, fromMetadata: true, readPayloads: true}
+	err := walker.copySegments(nil, func(*segment) bool { return false }, func(seg segment) error {
+		if seg.marker == SOI || seg.marker == EOI {
+			return nil
+		}
+		if !o.isMetadataSegment(&seg) {
+			if o.observe != nil {
+				o.observe(&seg, true, false)
+			}
+			return nil
+		}
+		err := o.countMetadata(&seg, &copied)
+		if err != nil { return err }
+		item := metadataItem{seg: seg}
+		payload := seg.payload
+		switch {
+			case seg.marker == APP1 && seg.ident == "EXIF":
+				if o.rewritesSegment(&seg) {
+					payload, err = o.rewriteSegment(&seg, payload)
+					if err != nil { return err }
+					if payload == nil {
+						return nil
+					}
+				}
+				item.kind, item.data = "EXIF", payload[len(exifHeader):]
+			case seg.marker == APP1 && seg.ident == "XMP" && bytes.HasPrefix(payload, []byte(xmpHeader)):
+				item.kind, item.data = "XMP", payload[len(xmpHeader):]
+			case seg.marker == APP2 && seg.ident == "ICC" && len(payload) >= iccHeaderLength:
+				// The chunks of the profile are assumed to be in order
+				if icc != nil {
+					icc.data = append(icc.data, payload[iccHeaderLength:]...)
+					icc.seg.length += seg.length
+					return nil
+				}
+				item.kind, item.data = "ICC", payload[iccHeaderLength:]
+			case seg.marker == COM:
+				item.kind, item.data = "COM", payload
+		}
+		items = append(items, item)
+		if item.kind == "ICC" {
+			icc = &items[len(items) - 1]
+		}
+		return nil
+	})
+	return items, err
+}
+
+// Writes the metadata read from a metadata source other than a JPEG as the equivalent JPEG segments,
+// to trailer rather than dst if it is not nil and the options relocate them there.
+func writeMetadataSegments(ctx context.Context, dst, trailer *bufio.Writer, metadata *bufio.Reader, o *options) error {
+	items, err := readMetadataItems(ctx, metadata, o)
+	if err != nil { return err }
+	walker := &segmentWalker{opts: o, trailer: trailer}
+	for i := range items {
+		item := &items[i]
+		add := true
+		switch item.kind {
+			case "EXIF":
+				err = writeSegment(walker.destination(dst, APP1), APP1, append([]byte(exifHeader), item.data...))
+			case "XMP":
+				err = writeSegment(walker.destination(dst, APP1), APP1, append([]byte(xmpHeader), item.data...))
+			case "ICC":
+				err = writeICCSegments(walker.destination(dst, APP2), item.data)
+			case "COM":
+				err = writeSegment(walker.destination(dst, COM), COM, item.data)
+			default:
+				add = false
+		}
+		if err != nil { return err }
+		if o.observe != nil {
+			o.observe(&item.seg, true, add)
+		}
+	}
+	return nil
+}
+
+func readWebPMetadataItems(ctx context.Context, metadata *bufio.Reader, o *options) ([]metadataItem, error) {
+	chunks, _, err := readWebP(ctx, metadata)
+	if err != nil { return nil, err }
+	raw := make([]rawMetadata, len(chunks))
+	for i := range chunks {
+		raw[i].seg, raw[i].isMetadata = chunks[i].segment()
+		raw[i].payload = chunks[i].payload
+	}
+	return rawMetadataItems(ctx, raw, o)
+}
+
+// rawMetadata is a piece of data read from a metadata source other than a JPEG,
+// along with the equivalent JPEG segment.
+type rawMetadata struct {
+	seg segment
+	isMetadata bool
+	payload []byte // EXIF payloads may lack the EXIF header, as is usual outside of JPEGs
+}
+
+// Turns the raw data of a metadata source other than a JPEG into the metadata items to be copied.
+func rawMetadataItems(ctx context.Context, raw []rawMetadata, o *options) ([]metadataItem, error) {
+	var items []metadataItem
+	var copied int64
+	for i := range raw {
+		err := ctx.Err()
+		if err != nil { return nil, err }
+		seg := raw[i].seg
+		seg.payload = raw[i].payload
+		if !raw[i].isMetadata || !o.isMetadataSegment(&seg) {
+			if o.observe != nil {
+				o.observe(&seg, true, false)
+			}
+			continue
+		}
+		err = o.countMetadata(&seg, &copied)
+		if err != nil { return nil, err }
+		payload := raw[i].payload
+		if o.rewritesSegment(&seg) {
+			payload, err = o.rewriteRawEXIF(&seg, payload)
+			if err != nil { return nil, err }
+			if payload == nil {
+				continue
+			}
+		}
+		items = append(items, metadataItem{seg: seg, kind: seg.ident, data: bytes.TrimPrefix(payload, []byte(exifHeader))})
+	}
+	return items, nil
+}
+
+// Like rewriteSegment, but for EXIF payloads which may lack the EXIF header, as is usual outside of JPEGs.
+func (o *options) rewriteRawEXIF(seg *segment, payload []byte) ([]byte, error) {
+	if bytes.HasPrefix(payload, []byte(exifHeader)) {
+		return o.rewriteSegment(seg, payload)
+	}
+	payload, err := o.rewriteSegment(seg, append([]byte(exifHeader), payload...))
+	if err != nil || payload == nil {
+		return nil, err
+	}
+	return payload[len(exifHeader):], nil
+}
+
+// Reports whether the metadata source, read into memory, holds any metadata to be copied under the options.
+func hasMetadata(data []byte, o *options) (bool, error) {
+	if isHEIF(data) {
+		raw, err := readHEIF(data)
+		if err != nil { return false, err }
+		for i := range raw {
+			seg := raw[i].seg
+			seg.payload = raw[i].payload
+			if o.isMetadataSegment(&seg) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	inventory, err := inspect(bytes.NewReader(data), o)
+	if err != nil { return false, err }
+	return inventory.MetadataBytes > 0, nil
+}
@@ -0,0 +1,456 @@
+package scrubbish
+
+import (
+	"io"
+	"bytes"
+	"fmt"
+	"bufio"
+	"log"
+)
+
+// Option configures ReplaceMetadata and Merge.
+type Option func(*options)
+
+type options struct {
+	stripTrailer bool
+	keepTrailer bool
+	force bool
+	exif []byte
+	bufferSize int
+	reflinkBackup bool
+	keep []byte
+	strip []byte
+	stripGPS bool
+	inventory *Inventory // if not nil, EXIF segments are only parsed to find GPS information, for Inspect
+	stripMakerNote bool
+	redactDates bool
+	keepOrientation bool
+	keepThumbnail bool
+	comment string
+	keepBackup bool
+	inPlace bool
+	backupSuffix string
+	backupDir string
+	verify bool
+	verifyScan bool
+	preserveTimes bool
+	validateICC bool
+	keepXMP bool
+	stripXMP bool
+	iccOnly bool
+	keepIfEmptySource bool
+	emptySource bool // set by Merge if the metadata source holds no metadata under WithKeepIfEmptySource
+	logger *log.Logger
+	repairEOI bool
+	dedup bool
+	maxMetadataBytes int64
+	maxFileSize int64
+	metadataFirst bool
+	strict bool
+	inflateComments bool
+	trailerMarkers []byte
+	result *Result
+	filter func(marker byte, payload []byte) bool
+	filterPayloads bool
+	stripping bool // set by Merge if there is no metadata source
+	// observe, if not nil, is called with the decision on every segment (except SOI and EOI)
+	observe func(seg *segment, fromMetadata, kept bool)
+}
+
+// Wraps r in a buffered reader of the configured size.
+func (o *options) newReader(r io.Reader) *bufio.Reader {
+	if o.bufferSize > defaultBufferSize {
+		return bufio.NewReaderSize(r, o.bufferSize)
+	}
+	return bufio.NewReader(r)
+}
+
+// Wraps w in a buffered writer of the configured size.
+func (o *options) newWriter(w io.Writer) *bufio.Writer {
+	if o.bufferSize > defaultBufferSize {
+		return bufio.NewWriterSize(w, o.bufferSize)
+	}
+	return bufio.NewWriter(w)
+}
+
+// Reports whether segments with the marker are to be written after the EOI under the options.
+func (o *options) isTrailerMarker(marker byte) bool {
+	return ((marker >= APP0 && marker <= APP15) || marker == COM) && bytes.IndexByte(o.trailerMarkers, marker) >= 0
+}
+
+// Reports whether segments with the marker are treated as metadata under the options.
+func (o *options) isMetadata(marker byte) bool {
+	for _, keep := range o.keep {
+		if marker == keep {
+			return false
+		}
+	}
+	if len(o.strip) > 0 {
+		for _, strip := range o.strip {
+			if marker == strip {
+				return true
+			}
+		}
+		return false
+	}
+	return isMetaTagType(marker)
+}
+
+// Reports whether the segment is treated as metadata under the options.
+// Unlike isMetadata, this considers the identifiers of APP1 segments,
+// which tell EXIF from XMP, and EXIF segments which are rewritten rather than stripped.
+func (o *options) isMetadataSegment(seg *segment) bool {
+	if o.emptySource {
+		return false
+	}
+	if o.iccOnly {
+		return seg.marker == APP2 && seg.ident == "ICC"
+	}
+	if o.stripping && o.rewritesSegment(seg) {
+		return false
+	}
+	if seg.marker == APP1 && ((o.keepXMP && seg.ident == "XMP") || (o.stripXMP && seg.ident != "XMP")) {
+		return false
+	}
+	if seg.marker == APP14 && seg.ident == "Adobe" && bytes.IndexByte(o.strip, APP14) < 0 {
+		// The Adobe segment holds the color transform without which CMYK and YCCK JPEGs render with wrong colors.
+		// It precedes the frame header which tells the number of components, so it is kept regardless.
+		return false
+	}
+	if !o.isMetadata(seg.marker) {
+		return false
+	}
+	if o.filter == nil {
+		return true
+	}
+	var payload []byte
+	if o.filterPayloads {
+		payload = seg.payload
+	}
+	return o.filter(seg.marker, payload)
+}
+
+// Reports whether the payloads of JPEG segments with the marker need to be read before deciding on them,
+// since the filter of the options inspects them.
+func (o *options) needsPayload(marker byte) bool {
+	return o.filter != nil && o.filterPayloads && o.isMetadata(marker)
+}
+
+// Reports whether the payload of the segment is to be rewritten when it is copied.
+func (o *options) rewritesSegment(seg *segment) bool {
+	return (o.inventory != nil || o.stripsEXIFTags() || (o.stripping && (o.keepOrientation || o.keepThumbnail))) && seg.marker == APP1 && seg.ident == "EXIF"
+}
+
+// Reports whether only some tags are to be removed from (or redacted in) EXIF segments, which are otherwise kept.
+func (o *options) stripsEXIFTags() bool {
+	return o.stripGPS || o.stripMakerNote || o.redactDates
+}
+
+// Rewrites the payload of a segment for which rewritesSegment returned true.
+// Returns a nil payload if the segment is to be dropped.
+func (o *options) rewriteSegment(seg *segment, payload []byte) ([]byte, error) {
+	if o.inventory != nil {
+		o.inventory.inspectEXIF(seg, payload)
+		return payload, nil
+	}
+	return rewriteEXIF(payload, func(t *tiff) {
+		if o.stripping && !o.stripsEXIFTags() {
+			keepOnly(t, o.keepOrientation, o.keepThumbnail)
+		}
+		if o.stripGPS {
+			stripGPS(t)
+		}
+		if o.stripMakerNote {
+			stripMakerNote(t)
+		}
+		if o.redactDates {
+			redactDates(t)
+		}
+	})
+}
+
+// Adds the length of a segment to be copied from the metadata source to *copied,
+// returning a ParseError if this exceeds the limit of the options.
+func (o *options) countMetadata(seg *segment, copied *int64) error {
+	*copied += int64(seg.length)
+	if o.maxMetadataBytes > 0 && *copied > o.maxMetadataBytes {
+		return &ParseError{Offset: seg.offset, Kind: "too much metadata", Msg: fmt.Sprintf("(more than %d bytes)", o.maxMetadataBytes)}
+	}
+	return nil
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{backupSuffix: "~"}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithStripTrailer sets whether trailing data after EOI is stripped.
+// By default, trailing data in the image raises an error; trailing data in the metadata source is always ignored.
+func WithStripTrailer(strip bool) Option {
+	return func(o *options) { o.stripTrailer = strip }
+}
+
+// WithForce allows operations which are refused by default since they likely destroy data:
+// Stripping the trailer of an image with an MPF segment (see ErrMPFTrailer)
+// and overwriting an existing backup, e.g. one left behind by a crash.
+func WithForce() Option {
+	return func(o *options) { o.force = true }
+}
+
+// WithKeepTrailer copies trailing data after the EOI of the image verbatim to the output,
+// e.g. to preserve images appended by phone cameras; trailing data of the metadata source is ignored.
+// It takes precedence over WithStripTrailer.
+func WithKeepTrailer() Option {
+	return func(o *options) { o.keepTrailer = true }
+}
+
+// WithKeep excludes the given markers from the metadata,
+// so that segments with these markers are kept from the image rather than stripped or replaced.
+// For example, WithKeep(0xE2) preserves ICC profiles.
+func WithKeep(markers ...byte) Option {
+	return func(o *options) { o.keep = append(o.keep, markers...) }
+}
+
+// WithStrip treats only the given markers as metadata, instead of APP1-APP14 and COM.
+// For example, WithStrip(0xE1, 0xFE) strips EXIF and comments but leaves ICC profiles and IPTC data intact.
+// WithKeep takes precedence over WithStrip.
+// Adobe APP14 segments, which hold the color transform of CMYK and YCCK JPEGs, are only stripped
+// if WithStrip is given APP14; otherwise they are kept from the image and not copied from the metadata source.
+func WithStrip(markers ...byte) Option {
+	return func(o *options) { o.strip = append(o.strip, markers...) }
+}
+
+// WithFilter narrows down the metadata: A segment which the other options treat as metadata is only stripped
+// from the image (or copied from the metadata source) if filter returns true for its marker and payload,
+// e.g. to only strip EXIF segments holding GPS information.
+// The payload (excluding the length bytes) is nil unless requested with WithFilterPayloads.
+// Outside of JPEGs, filter is passed the marker of the equivalent segment (e.g. APP1 for EXIF chunks) and the data of the chunk or item;
+// the payload of TIFF entries is always nil. filter may be called more than once per segment and must not modify the payload.
+func WithFilter(filter func(marker byte, payload []byte) bool) Option {
+	return func(o *options) { o.filter = filter }
+}
+
+// WithFilterPayloads passes the payloads of the segments to the filter of WithFilter.
+// This requires reading each metadata segment into memory before the decision rather than streaming it.
+func WithFilterPayloads() Option {
+	return func(o *options) { o.filterPayloads = true }
+}
+
+// WithStripGPS removes only the GPS information from EXIF segments instead of stripping them entirely:
+// When stripping, the EXIF segments of the image are kept without their GPS IFD;
+// when replacing, the EXIF segments of the metadata source are copied without it.
+// The EXIF structure is laid out anew, so offsets within proprietary maker notes may break.
+func WithStripGPS() Option {
+	return func(o *options) { o.stripGPS = true }
+}
+
+// WithStripMakerNote removes only the maker note (tag 0x927C of the EXIF IFD), which holds proprietary,
+// often large vendor data such as serial numbers, from EXIF segments instead of stripping them entirely,
+// just like WithStripGPS removes the GPS IFD. Both may be combined. By default, the maker note is kept.
+func WithStripMakerNote() Option {
+	return func(o *options) { o.stripMakerNote = true }
+}
+
+// WithRedactDates keeps EXIF segments but blanks their dates (DateTime, DateTimeOriginal and DateTimeDigitized)
+// instead of stripping them entirely, e.g. to keep technical information such as the camera and lens
+// while preventing correlation by time. It may be combined with WithStripGPS and WithStripMakerNote.
+func WithRedactDates() Option {
+	return func(o *options) { o.redactDates = true }
+}
+
+// WithKeepOrientation keeps the orientation when stripping EXIF segments:
+// They are replaced by minimal EXIF segments containing only the orientation tag, if present.
+// It has no effect when replacing metadata, or with WithStripGPS, WithStripMakerNote or WithRedactDates (which keep the orientation anyway).
+func WithKeepOrientation() Option {
+	return func(o *options) { o.keepOrientation = true }
+}
+
+// WithKeepThumbnail keeps the thumbnail when stripping EXIF segments:
+// They are replaced by minimal EXIF segments containing only the thumbnail and IFD1, which describes it, if present
+// (along with the resolution, which IFD0 needs to hold, and the orientation, given WithKeepOrientation).
+// It has no effect when replacing metadata, or with WithStripGPS, WithStripMakerNote or WithRedactDates (which keep the thumbnail anyway).
+func WithKeepThumbnail() Option {
+	return func(o *options) { o.keepThumbnail = true }
+}
+
+// WithComment adds a COM segment containing the comment after the metadata.
+// Comments too long for a single segment are split across several segments.
+func WithComment(comment string) Option {
+	return func(o *options) { o.comment = comment }
+}
+
+// WithEXIF uses the EXIF payload (with or without the "Exif\x00\x00" header),
+// or equivalently a TIFF structure such as a DNG or TIFF sidecar, as metadata source:
+// It is wrapped in an APP1 segment which replaces the metadata of the image.
+// There must be no other metadata source; in particular, ReplaceMetadata requires an empty fromPath.
+func WithEXIF(exif []byte) Option {
+	return func(o *options) { o.exif = exif }
+}
+
+// Size of the buffers of bufio
+const defaultBufferSize = 4096
+
+// WithBufferSize sets the size of the buffers Merge reads and writes through,
+// which may speed up processing of large files. Sizes below the default of 4096 bytes are ignored.
+func WithBufferSize(size int) Option {
+	return func(o *options) { o.bufferSize = size }
+}
+
+// WithKeepBackup keeps the backup made by ReplaceMetadata after it succeeds.
+func WithKeepBackup() Option {
+	return func(o *options) { o.keepBackup = true }
+}
+
+// WithInPlace makes ReplaceMetadata write the result to a temporary file next to the destination
+// and rename it over the destination once it is complete (and verified, given WithVerify or WithVerifyScan),
+// rather than moving the destination to a backup first. The destination is never touched before success,
+// and no backup is created, so the backup options have no effect.
+func WithInPlace() Option {
+	return func(o *options) { o.inPlace = true }
+}
+
+// WithReflinkBackup makes ReplaceMetadata create the backup as a reflink clone sharing the data of the file,
+// which is nearly free on copy-on-write file systems, and leaves the file in place until the result replaces it.
+// If cloning fails, e.g. because the file system doesn't support it, the file is moved to the backup as usual.
+// Cloning is supported on Linux (Btrfs, XFS and the like) and macOS (APFS).
+func WithReflinkBackup() Option {
+	return func(o *options) { o.reflinkBackup = true }
+}
+
+// WithBackupSuffix sets the suffix appended to the file name of the backup made by ReplaceMetadata.
+// The default is "~".
+func WithBackupSuffix(suffix string) Option {
+	return func(o *options) { o.backupSuffix = suffix }
+}
+
+// WithBackupDir places the backup made by ReplaceMetadata in dir, which is created if necessary,
+// rather than next to the file. The backup keeps the base name of the file (plus the backup suffix),
+// so files with the same name from different directories must not be processed concurrently.
+func WithBackupDir(dir string) Option {
+	return func(o *options) { o.backupDir = dir }
+}
+
+// WithVerify makes ReplaceMetadata re-parse the output before removing the backup.
+// If the output turns out to be malformed, the backup is restored.
+func WithVerify() Option {
+	return func(o *options) { o.verify = true }
+}
+
+// WithVerifyScan makes ReplaceMetadata check that the image data (all segments but APPn and COM,
+// including the entropy-coded data) of the output is identical to that of the original,
+// by comparing SHA-256 hashes, before removing the backup. Otherwise, the backup is restored.
+// Only JPEGs are supported.
+func WithVerifyScan() Option {
+	return func(o *options) { o.verifyScan = true }
+}
+
+// WithPreserveTimes makes ReplaceMetadata give the result the modification time of the original.
+// The permissions of the original are always preserved.
+func WithPreserveTimes() Option {
+	return func(o *options) { o.preserveTimes = true }
+}
+
+// WithValidateICC checks that the chunks of copied ICC profiles (APP2 segments) are complete and in order,
+// failing with a ParseError if chunks are missing, duplicated, reordered or disagree on their count.
+func WithValidateICC() Option {
+	return func(o *options) { o.validateICC = true }
+}
+
+// WithKeepXMP keeps XMP (APP1 segments with the XMP namespace identifier) from the image
+// rather than treating it as metadata, so that e.g. only EXIF is stripped or replaced.
+func WithKeepXMP() Option {
+	return func(o *options) { o.keepXMP = true }
+}
+
+// WithStripXMP treats only XMP as metadata among APP1 segments,
+// so that e.g. XMP is stripped or replaced while EXIF is kept from the image.
+func WithStripXMP() Option {
+	return func(o *options) { o.stripXMP = true }
+}
+
+// WithICCOnly treats only ICC profiles as metadata, taking precedence over the other options selecting metadata:
+// Merging transplants the ICC profile of the metadata source, keeping all other metadata of the image,
+// such as its EXIF; other APP2 segments such as MPF are kept as well. If the metadata source has no ICC profile,
+// the image ends up without one. Stripping removes only the ICC profile.
+func WithICCOnly() Option {
+	return func(o *options) { o.iccOnly = true }
+}
+
+// WithKeepIfEmptySource keeps the metadata of the image if the metadata source holds none
+// (as selected by the other options), rather than effectively stripping the image.
+// The metadata source is read into memory to find out. See also Result.EmptySource.
+func WithKeepIfEmptySource() Option {
+	return func(o *options) { o.keepIfEmptySource = true }
+}
+
+// WithRepairEOI tolerates inputs which end without an EOI, such as truncated downloads,
+// provided that everything up to the end parses cleanly. The output gets an EOI as usual.
+// Without it, a missing EOI is an error.
+func WithRepairEOI() Option {
+	return func(o *options) { o.repairEOI = true }
+}
+
+// WithLogger logs the decision on each segment to the logger,
+// e.g. "keep APP0 from image (16 bytes)", "drop APP1 from image (4521 bytes)" or "add APP1 from metadata (3320 bytes)",
+// followed by how many metadata bytes were removed after merging succeeds.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithDedup drops metadata segments of the metadata source which are byte-identical to one copied before,
+// e.g. repeated comments.
+func WithDedup() Option {
+	return func(o *options) { o.dedup = true }
+}
+
+// WithMaxMetadataBytes limits the total length of the metadata segments copied from the metadata source to n bytes;
+// exceeding it results in a *ParseError. This protects against pathological inputs, e.g. untrusted uploads.
+// By default, the metadata is unlimited.
+func WithMaxMetadataBytes(n int64) Option {
+	return func(o *options) { o.maxMetadataBytes = n }
+}
+
+// WithMaxFileSize limits the size of the image and of the metadata source to n bytes each:
+// ReplaceMetadata checks the sizes of the files up front, and Merge fails with ErrTooLarge
+// as soon as more than n bytes have been read from either, which protects against huge untrusted inputs.
+// By default, the size is unlimited.
+func WithMaxFileSize(n int64) Option {
+	return func(o *options) { o.maxFileSize = n }
+}
+
+// WithMetadataFirst places the metadata (and comment) of JPEGs right after SOI,
+// rather than after the APP0 (JFIF) segments of the image, which by convention come first.
+func WithMetadataFirst() Option {
+	return func(o *options) { o.metadataFirst = true }
+}
+
+// WithStrict makes Merge fail on questionable but technically processable input rather than passing it through:
+// JPEG output holding both JFIF and EXIF segments (see ErrJFIFAndEXIF), which is otherwise only logged as a warning,
+// and reserved JPEG markers (0x02-0xBF, JPG and JPG0-JPG13; a *ParseError), whose segments are otherwise copied as they are.
+func WithStrict() Option {
+	return func(o *options) { o.strict = true }
+}
+
+// WithResult makes Merge store what it did in *result once it succeeds.
+// ReplaceMetadata stores the result of the merge it performs; a file which is already clean leaves *result untouched.
+func WithResult(result *Result) Option {
+	return func(o *options) { o.result = result }
+}
+
+// WithInflateComments inflates zlib-compressed comments, as some tools write them, when inspecting metadata:
+// List shows the text of comments, and Extract writes compressed comments inflated.
+// Merge and ReplaceMetadata ignore it; comments are always copied as they are.
+func WithInflateComments() Option {
+	return func(o *options) { o.inflateComments = true }
+}
+
+// WithTrailerMarkers writes the APPn and COM segments with the given markers which end up in JPEG output,
+// including the comment, after the EOI rather than before the image data, for formats which expect them there.
+// They follow the trailer of the image, if it is kept (see WithKeepTrailer), so that offsets into it stay intact.
+// Other markers are ignored.
+func WithTrailerMarkers(markers ...byte) Option {
+	return func(o *options) { o.trailerMarkers = append(o.trailerMarkers, markers...) }
+}
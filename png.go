@@ -0,0 +1,277 @@
+package scrubbish
+
+import (
+	"io"
+	"context"
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"compress/zlib"
+	"unicode/utf8"
+	"encoding/binary"
+)
+
+// PNG files consist of a signature followed by chunks, each consisting of the big-endian length of the data,
+// the chunk type, the data, and a CRC of type and data. IHDR comes first and IEND last.
+// Metadata lives in ancillary chunks: eXIf (EXIF), iCCP (ICC profile), tEXt, zTXt and iTXt (text, including XMP)
+// and tIME (modification time). These are treated like the equivalent JPEG segments:
+// eXIf and XMP like APP1, iCCP like APP2, and the other text chunks and tIME like COM.
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// Reports whether head, the first bytes of a file, is the PNG signature.
+func isPNG(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(pngSignature))
+}
+
+// Keyword of iTXt chunks holding XMP
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// Reports whether chunks of the type hold metadata.
+func isPNGMetadataType(typ string) bool {
+	switch typ {
+		case "eXIf", "iCCP", "tEXt", "zTXt", "iTXt", "tIME":
+			return true
+	}
+	return false
+}
+
+// Sets the marker and identifier of the JPEG segment equivalent to the PNG metadata chunk with the given data.
+func (seg *segment) classifyPNG(typ string, data []byte) {
+	switch {
+		case typ == "eXIf":
+			seg.marker, seg.ident = APP1, "EXIF"
+		case typ == "iTXt" && bytes.HasPrefix(data, []byte(pngXMPKeyword + "\x00")):
+			seg.marker, seg.ident = APP1, "XMP"
+		case typ == "iCCP":
+			seg.marker, seg.ident = APP2, "ICC"
+		default:
+			seg.marker = COM
+	}
+}
+
+// Writes a chunk, computing its CRC.
+func writePNGChunk(w *bufio.Writer, typ string, data []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	copy(header[4:], typ)
+	_, err := w.Write(header[:])
+	if err != nil { return err }
+	_, err = w.Write(data)
+	if err != nil { return err }
+	crc := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, data)
+	binary.BigEndian.PutUint32(header[:4], crc)
+	_, err = w.Write(header[:4])
+	return err
+}
+
+// Like mergeJPEG, but for PNG images. The metadata source may be a PNG, a JPEG or a WebP.
+// The metadata (and comment) is placed right after IHDR.
+// Chunks are streamed; only those holding metadata are read into memory.
+func mergePNG(ctx context.Context, out *bufio.Writer, image *bufio.Reader, metadata io.Reader, o *options) error {
+	var signature [len(pngSignature)]byte
+	_, err := io.ReadFull(image, signature[:])
+	if err != nil { return err }
+	if !isPNG(signature[:]) {
+		return &ParseError{Offset: 0, Kind: "expected PNG signature"}
+	}
+	_, err = out.Write(signature[:])
+	if err != nil { return err }
+	offset := int64(len(pngSignature))
+	for {
+		err = ctx.Err()
+		if err != nil { return err }
+		var header [8]byte
+		_, err = io.ReadFull(image, header[:])
+		if err != nil { return err }
+		length := binary.BigEndian.Uint32(header[:])
+		typ := string(header[4:])
+		if offset == int64(len(pngSignature)) && typ != "IHDR" {
+			return &ParseError{Offset: offset, Kind: "expected IHDR", Msg: fmt.Sprintf("(got %q)", typ)}
+		}
+		if length > 1 << 31 - 1 {
+			return &ParseError{Offset: offset, Kind: "invalid chunk length", Msg: fmt.Sprint(length)}
+		}
+		seg := segment{offset: offset, length: int(length), name: typ}
+		keep := true
+		if isPNGMetadataType(typ) {
+			var data []byte
+			data, err = readN(image, int64(length) + 4) // including the CRC
+			if err != nil { return err }
+			seg.classifyPNG(typ, data)
+			seg.payload = data[:length]
+			keep = !o.isMetadataSegment(&seg)
+			if keep && o.rewritesSegment(&seg) {
+				var exif []byte
+				exif, err = o.rewriteRawEXIF(&seg, data[:length])
+				if err != nil { return err }
+				keep = exif != nil
+				if keep {
+					err = writePNGChunk(out, typ, exif)
+				}
+			} else if keep {
+				_, err = out.Write(header[:])
+				if err != nil { return err }
+				_, err = out.Write(data)
+			}
+		} else {
+			_, err = out.Write(header[:])
+			if err != nil { return err }
+			_, err = io.CopyN(out, image, int64(length) + 4)
+		}
+		if err != nil { return err }
+		if o.observe != nil {
+			o.observe(&seg, false, keep)
+		}
+		offset += 12 + int64(length)
+		if typ == "IHDR" {
+			if metadata != nil {
+				err = copyPNGMetadata(ctx, out, o.newReader(metadata), o)
+				if err != nil { return err }
+			}
+			if o.comment != "" {
+				err = writePNGComment(out, o)
+				if err != nil { return err }
+			}
+		}
+		if typ == "IEND" {
+			break
+		}
+	}
+	err = checkTrailer(image, offset, o)
+	if err != nil { return err }
+	if o.keepTrailer {
+		_, err = io.Copy(out, image)
+	}
+	return err
+}
+
+// Writes the metadata chunks of a PNG metadata source verbatim,
+// or converts the metadata of a JPEG or WebP metadata source to the equivalent PNG chunks.
+func copyPNGMetadata(ctx context.Context, out *bufio.Writer, metadata *bufio.Reader, o *options) error {
+	head, _ := metadata.Peek(len(pngSignature))
+	if !isPNG(head) {
+		items, err := readMetadataItems(ctx, metadata, o)
+		if err != nil { return err }
+		for i := range items {
+			item := &items[i]
+			add := item.kind != ""
+			switch item.kind {
+				case "EXIF":
+					err = writePNGChunk(out, "eXIf", item.data)
+				case "XMP":
+					err = writePNGText(out, pngXMPKeyword, item.data)
+				case "ICC":
+					err = writePNGICC(out, item.data)
+				case "COM":
+					var typ string
+					typ, err = writePNGCommentChunk(out, item.data)
+					add = typ != ""
+			}
+			if err != nil { return err }
+			if o.observe != nil {
+				o.observe(&item.seg, true, add)
+			}
+		}
+		return nil
+	}
+	_, err := metadata.Discard(len(pngSignature))
+	if err != nil { return err }
+	offset := int64(len(pngSignature))
+	var copied int64
+	for {
+		err = ctx.Err()
+		if err != nil { return err }
+		var header [8]byte
+		_, err = io.ReadFull(metadata, header[:])
+		if err != nil { return err }
+		length := binary.BigEndian.Uint32(header[:])
+		typ := string(header[4:])
+		if length > 1 << 31 - 1 {
+			return &ParseError{Offset: offset, Kind: "invalid chunk length", Msg: fmt.Sprint(length)}
+		}
+		seg := segment{offset: offset, length: int(length), name: typ}
+		add := false
+		if isPNGMetadataType(typ) {
+			var data []byte
+			data, err = readN(metadata, int64(length) + 4)
+			if err != nil { return err }
+			seg.classifyPNG(typ, data)
+			seg.payload = data[:length]
+			add = o.isMetadataSegment(&seg)
+			if add {
+				err = o.countMetadata(&seg, &copied)
+				if err != nil { return err }
+			}
+			if add && o.rewritesSegment(&seg) {
+				var exif []byte
+				exif, err = o.rewriteRawEXIF(&seg, data[:length])
+				if err != nil { return err }
+				add = exif != nil
+				if add {
+					err = writePNGChunk(out, typ, exif)
+				}
+			} else if add {
+				_, err = out.Write(header[:])
+				if err != nil { return err }
+				_, err = out.Write(data)
+			}
+		} else {
+			_, err = metadata.Discard(int(length) + 4)
+		}
+		if err != nil { return err }
+		if o.observe != nil {
+			o.observe(&seg, true, add)
+		}
+		offset += 12 + int64(length)
+		if typ == "IEND" {
+			return nil
+		}
+	}
+}
+
+// Writes an uncompressed iTXt chunk with the keyword and text, which must be UTF-8, without language tag or translated keyword.
+func writePNGText(out *bufio.Writer, keyword string, text []byte) error {
+	data := append([]byte(keyword), 0, 0, 0, 0, 0)
+	return writePNGChunk(out, "iTXt", append(data, text...))
+}
+
+// Writes an iCCP chunk holding the (compressed) ICC profile.
+func writePNGICC(out *bufio.Writer, profile []byte) error {
+	var data bytes.Buffer
+	data.WriteString("ICC Profile\x00\x00")
+	compressor := zlib.NewWriter(&data)
+	_, err := compressor.Write(profile)
+	if err != nil { return err }
+	err = compressor.Close()
+	if err != nil { return err }
+	return writePNGChunk(out, "iCCP", data.Bytes())
+}
+
+// Writes the comment as an iTXt chunk with the keyword "Comment" if it is valid UTF-8, as iTXt requires.
+// Otherwise, it is written as a tEXt chunk, whose text is Latin-1, unless it holds NUL bytes, which tEXt forbids;
+// such comments are skipped. Returns the type of the chunk written, if any.
+func writePNGCommentChunk(out *bufio.Writer, comment []byte) (string, error) {
+	if utf8.Valid(comment) {
+		return "iTXt", writePNGText(out, "Comment", comment)
+	}
+	if bytes.IndexByte(comment, 0) >= 0 {
+		return "", nil
+	}
+	return "tEXt", writePNGChunk(out, "tEXt", append([]byte("Comment\x00"), comment...))
+}
+
+// Writes the comment of the options as a chunk with the keyword "Comment".
+func writePNGComment(out *bufio.Writer, o *options) error {
+	typ, err := writePNGCommentChunk(out, []byte(o.comment))
+	if err != nil || typ == "" { return err }
+	if o.observe != nil {
+		length := len("Comment") + 5 + len(o.comment)
+		if typ == "tEXt" {
+			length = len("Comment") + 1 + len(o.comment)
+		}
+		o.observe(&segment{marker: COM, length: length, name: typ, comment: true}, true, true)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package scrubbish
+
+import (
+	"bytes"
+	"bufio"
+	"testing"
+)
+
+// Returns a PNG chunk with the type and data.
+func pngChunk(typ string, data []byte) []byte {
+	var chunk bytes.Buffer
+	w := bufio.NewWriter(&chunk)
+	writePNGChunk(w, typ, data)
+	w.Flush()
+	return chunk.Bytes()
+}
+
+// Returns a PNG with an IHDR chunk, the chunks and made-up image data.
+func testPNG(chunks ...[]byte) []byte {
+	png := append([]byte(pngSignature), pngChunk("IHDR", []byte{0, 0, 0, 16, 0, 0, 0, 16, 8, 0, 0, 0, 0})...) // 16x16 grayscale
+	for _, chunk := range chunks {
+		png = append(png, chunk...)
+	}
+	png = append(png, pngChunk("IDAT", []byte("image data"))...)
+	return append(png, pngChunk("IEND", nil)...)
+}
+
+func TestPNGComment(t *testing.T) {
+	image := testPNG()
+	for _, test := range []struct {
+		comment string
+		want []byte
+	}{
+		{"café", testPNG(pngChunk("iTXt", []byte("Comment\x00\x00\x00\x00\x00café")))},
+		// Not UTF-8, taken to be Latin-1
+		{"caf\xE9", testPNG(pngChunk("tEXt", []byte("Comment\x00caf\xE9")))},
+		// Neither UTF-8 nor allowed in tEXt
+		{"caf\xE9\x00", image},
+	} {
+		donor := withSegments(testJPEG{ecsLength: 10}.bytes(), commentSegment(test.comment))
+		copied, err := ReplaceBytes(image, donor)
+		if err != nil { t.Fatal(err) }
+		added, err := ReplaceBytes(image, nil, WithComment(test.comment))
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(copied, test.want) || !bytes.Equal(added, test.want) {
+			t.Errorf("comment %q: got % X when copied and % X when added, want % X", test.comment, copied, added, test.want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build darwin
+
+package scrubbish
+
+import (
+	"os"
+	"golang.org/x/sys/unix"
+)
+
+// Makes dst share the data of src, if the file system supports it (e.g. APFS).
+// clonefile(2) creates the clone itself, so the empty file dst was opened as is replaced by it.
+func reflink(dst, src *os.File) error {
+	err := os.Remove(dst.Name())
+	if err != nil { return err }
+	return unix.Fclonefileat(int(src.Fd()), unix.AT_FDCWD, dst.Name(), 0)
+}
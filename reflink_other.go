@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package scrubbish
+
+import (
+	"os"
+	"errors"
+)
+
+func reflink(dst, src *os.File) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,56 @@
+package scrubbish
+
+import (
+	"os"
+	"io"
+	"context"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"crypto/sha256"
+)
+
+// Computes the SHA-256 hash of the image data of the JPEG read from r:
+// all segments except APPn and COM, including the entropy-coded data, as they would be copied.
+// Fill bytes and trailing data are ignored.
+func scanHash(r io.Reader, o *options) ([]byte, error) {
+	hash := sha256.New()
+	writer := bufio.NewWriter(hash)
+	walker := &segmentWalker{ctx: context.Background(), src: bufio.NewReader(r), opts: &options{stripTrailer: true, repairEOI: o.repairEOI}}
+	err := walker.copySegments(writer, func(seg *segment) bool {
+		return !(seg.marker >= APP0 && seg.marker <= APP15) && seg.marker != COM
+	}, nil)
+	if err != nil { return nil, err }
+	err = writer.Flush()
+	if err != nil { return nil, err }
+	return hash.Sum(nil), nil
+}
+
+func fileScanHash(path string, o *options) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	format, err := DetectFormat(reader)
+	if err != nil { return nil, err }
+	if format != JPEG {
+		return nil, fmt.Errorf("verifying the image data of a %s isn't supported", format)
+	}
+	return scanHash(reader, o)
+}
+
+// Checks that the image data of the JPEG at outPath is identical to that of the JPEG at inPath.
+func verifyScan(outPath, inPath string, o *options) error {
+	before, err := fileScanHash(inPath, o)
+	if err != nil { return err }
+	after, err := fileScanHash(outPath, o)
+	if err != nil { return err }
+	if !bytes.Equal(before, after) {
+		return errors.New("image data changed")
+	}
+	if o.logger != nil {
+		o.logger.Printf("image data unchanged (SHA-256 %x)", after)
+	}
+	return nil
+}
@@ -1,182 +1,609 @@
 /*
-Scrubbish takes metadata (EXIF, copyright info, comments) from a source JPEG file
-and replaces (or strips, if no source is provided) the metadata of a destination JPEG file with it.
-
-Usage:
-
-    scrubbish [flags] [source] destination
-
-The only flag is:
-
-    -strip-trailer
-        Strip trailing data after EOI.
-        By default, trailing data (in either source or destination) will raise an error.
-
-The source is optional; if none is provided, destination will be stripped of metadata,
-otherwise, the metadata of the destination will be replaced with that of the source.
-
-The destination is backed up to destination~ during the operation.
-After the operation succeeds, the backup is removed.
+Package scrubbish takes metadata (EXIF, copyright info, comments) from a source JPEG
+and replaces (or strips, if no source is provided) the metadata of a destination JPEG with it.
+WebP images (ICCP, EXIF and XMP chunks), PNG images (eXIf, iCCP, text and tIME chunks)
+and TIFF images (metadata tags) are supported as well; their metadata may also be taken from a JPEG.
 */
-package main
+package scrubbish
 
 import (
 	"os"
 	"io"
-	"bufio"
-	"errors"
+	"context"
 	"fmt"
-	"flag"
+	"errors"
+	"io/fs"
+	"math/rand"
+	"bufio"
+	"bytes"
 )
 
-var stripTrailer = flag.Bool("strip-trailer", false, "Strip an eventual trailer")
-func main() {
-	flag.Parse()
-	var from, to string
-	switch flag.NArg() {
-		case 1:
-			to = flag.Arg(0)
-		case 2:
-			from, to = flag.Arg(0), flag.Arg(1)
-		default:
-			fmt.Println("usage: scrubbish [flags] [source] destination")
-			return
-	}
-	err := replaceMetadata(to, from)
+// ReplaceMetadata replaces the metadata of toPath with that of fromPath (may be empty for stripping),
+// creating a temporary copy of toPath at toPath~ (see WithBackupSuffix and WithBackupDir) in the process,
+// which must not exist yet (see WithForce).
+// After success, the copy is removed (unless WithKeepBackup is given);
+// after failure, it is restored to toPath, discarding any partial output.
+// fromPath may refer to the same file as toPath, in which case the metadata is read from the copy.
+// If the result would be identical to toPath, e.g. when stripping an image without metadata,
+// toPath is left untouched and no copy is made.
+// Under WithInPlace, no copy is made either; see there.
+func ReplaceMetadata(toPath, fromPath string, opts ...Option) error {
+	return ReplaceMetadataContext(context.Background(), toPath, fromPath, opts...)
+}
+
+// ReplaceMetadataContext is like ReplaceMetadata, but stops early with ctx.Err() if ctx is done, like MergeContext,
+// restoring the destination from the backup.
+func ReplaceMetadataContext(ctx context.Context, toPath, fromPath string, opts ...Option) error {
+	o := newOptions(opts)
+	// Fail early, before anything has been moved
+	sameFile, err := o.checkInputs(toPath, fromPath)
+	if err != nil { return err }
+	same, err := unchanged(ctx, toPath, fromPath, opts)
+	if err != nil { return err }
+	if same {
+		if o.logger != nil {
+			o.logger.Printf("already clean, skipped")
+		}
+		return nil
+	}
+	if o.inPlace {
+		return merge(ctx, toPath, toPath, fromPath, opts, func(outPath string) error {
+			return o.verifyOutput(outPath, toPath)
+		})
+	}
+	if o.backupDir != "" {
+		err := os.MkdirAll(o.backupDir, 0o777)
+		if err != nil { return err }
+	}
+	copyPath := o.backupPath(toPath)
+	// A backup left behind by a crashed run may be the only good copy of the original
+	_, err = os.Lstat(copyPath)
+	if err == nil && !o.force {
+		return fmt.Errorf("backup already exists: %s (recover or remove it first)", copyPath)
+	}
+	if o.reflinkBackup {
+		err = cloneFile(toPath, copyPath)
+	}
+	if !o.reflinkBackup || err != nil {
+		err = moveFile(toPath, copyPath)
+		if err != nil { return err }
+	}
+	if sameFile {
+		// Read the metadata from the backup, since toPath will be replaced
+		fromPath = copyPath
+	}
+	err = merge(ctx, toPath, copyPath, fromPath, opts, nil)
+	if err == nil {
+		err = o.verifyOutput(toPath, copyPath)
+	}
 	if err != nil {
-		fmt.Println("scrubbish:", err)
+		restoreErr := moveFile(copyPath, toPath)
+		if restoreErr != nil {
+			return fmt.Errorf("%w (restoring backup %s: %v)", err, copyPath, restoreErr)
+		}
+		return err
+	}
+	if o.keepBackup {
+		return nil
 	}
+	return os.Remove(copyPath)
+}
+
+// MergeFiles is like ReplaceMetadata, but writes the result to outPath, leaving imagePath untouched.
+// No backup is made; as with WithInPlace, the result is written to a temporary file
+// which is only renamed to outPath once complete and verified. outPath is written even if nothing changes.
+func MergeFiles(outPath, imagePath, fromPath string, opts ...Option) error {
+	return MergeFilesContext(context.Background(), outPath, imagePath, fromPath, opts...)
 }
 
-// Replaces the metadata of toPath with that of fromPath (may be empty for stripping),
-// creating a temporary copy of toPath at toPath~ in the process.
-func replaceMetadata(toPath, fromPath string) error {
-	copyPath := toPath + "~"
-	err := os.Rename(toPath, copyPath)
+// MergeFilesContext is like MergeFiles, but stops early with ctx.Err() if ctx is done, like MergeContext,
+// in which case outPath is left untouched.
+func MergeFilesContext(ctx context.Context, outPath, imagePath, fromPath string, opts ...Option) error {
+	o := newOptions(opts)
+	_, err := o.checkInputs(imagePath, fromPath)
 	if err != nil { return err }
-    defer os.Remove(copyPath)
-    return merge(toPath, copyPath, fromPath)
+	return merge(ctx, outPath, imagePath, fromPath, opts, func(path string) error {
+		return o.verifyOutput(path, imagePath)
+	})
+}
+
+// Checks that the destination and the metadata source (if any) exist, are within the maximum size
+// and have matching formats, reporting whether they are the same file.
+func (o *options) checkInputs(toPath, fromPath string) (sameFile bool, err error) {
+	toInfo, err := os.Stat(toPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("destination does not exist: %s", toPath)
+	}
+	if err != nil { return false, err }
+	if fromPath != "" {
+		fromInfo, err := os.Stat(fromPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, fmt.Errorf("source does not exist: %s", fromPath)
+		}
+		if err != nil { return false, err }
+		sameFile = os.SameFile(toInfo, fromInfo)
+		if o.maxFileSize > 0 && fromInfo.Size() > o.maxFileSize {
+			return false, fmt.Errorf("%w: %s (%d bytes)", ErrTooLarge, fromPath, fromInfo.Size())
+		}
+	}
+	if o.maxFileSize > 0 && toInfo.Size() > o.maxFileSize {
+		return false, fmt.Errorf("%w: %s (%d bytes)", ErrTooLarge, toPath, toInfo.Size())
+	}
+	return sameFile, checkFormats(toPath, fromPath)
+}
+
+// ErrNotJPEG is returned if a JPEG is expected but the input doesn't start with SOI, naming its format if it is well-known,
+// e.g. by Validate or List, or by ReplaceMetadata if the metadata source for a JPEG is a PNG or TIFF,
+// whose metadata can't be copied to JPEGs. Unlike a ParseError, it indicates the wrong kind of file rather than a corrupt one.
+var ErrNotJPEG = errors.New("not a JPEG file (bad magic)")
+
+// Checks the formats of the destination and the metadata source (if any) by their magic up front,
+// so that the error names the offending file, rather than failing on its first bytes later on.
+// Besides the supported image formats, the metadata source may be a HEIF file.
+func checkFormats(toPath, fromPath string) error {
+	head, err := readFileHead(toPath)
+	if err != nil { return err }
+	toFormat := detectFormat(head)
+	if toFormat == 0 {
+		return unknownFormat(head, toPath)
+	}
+	if fromPath == "" {
+		return nil
+	}
+	head, err = readFileHead(fromPath)
+	if err != nil { return err }
+	if isHEIF(head) {
+		return nil
+	}
+	fromFormat := detectFormat(head)
+	if fromFormat == 0 {
+		return unknownFormat(head, fromPath)
+	}
+	if toFormat == JPEG && fromFormat != JPEG && fromFormat != WebP {
+		return fmt.Errorf("%w: %s", ErrNotJPEG, fromPath)
+	}
+	return nil
+}
+
+// Reads the first bytes of a file, as far as needed to detect its format.
+func readFileHead(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer file.Close()
+	head := make([]byte, formatHeaderLength)
+	n, err := io.ReadFull(file, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return head[:n], err
+}
+
+// Reports whether merging would leave the file at path unchanged, by comparing the output to the file.
+// This stops at the first difference, which is usually close to the start, where the metadata is.
+func unchanged(ctx context.Context, path, metadataImagePath string, opts []Option) (bool, error) {
+	imageFile, err := os.Open(path)
+	if err != nil { return false, err }
+	defer imageFile.Close()
+	original, err := os.Open(path)
+	if err != nil { return false, err }
+	defer original.Close()
+	var metadata io.Reader
+	if metadataImagePath != "" {
+		metaFile, err := os.Open(metadataImagePath)
+		if err != nil { return false, err }
+		defer metaFile.Close()
+		metadata = metaFile
+	}
+	comparer := &compareWriter{original: bufio.NewReader(original)}
+	// Don't append to the caller's slice; only log decisions when actually merging
+	opts = append(opts[:len(opts):len(opts)], func(o *options) { o.logger, o.result = nil, nil })
+	err = MergeContext(ctx, comparer, imageFile, metadata, opts...)
+	if err == errChanged {
+		return false, nil
+	}
+	if err != nil { return false, err }
+	// The original must not have more to it than the output
+	_, err = comparer.original.ReadByte()
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+var errChanged = errors.New("output differs from original")
+
+// compareWriter compares the bytes written to it to those read from original,
+// failing with errChanged at the first difference.
+type compareWriter struct {
+	original *bufio.Reader
+	buf []byte
+}
+
+func (w *compareWriter) Write(p []byte) (int, error) {
+	if cap(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+	buf := w.buf[:len(p)]
+	_, err := io.ReadFull(w.original, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && !bytes.Equal(buf, p)) {
+		return 0, errChanged
+	}
+	if err != nil { return 0, err }
+	return len(p), nil
+}
+
+// Checks that the file at path is a well-formed image (at a segment or chunk level)
+// without trailing data, unless the options keep the trailer.
+func verify(path string, o *options) error {
+	file, err := os.Open(path)
+	if err != nil { return err }
+	defer file.Close()
+	// Segments written after the EOI make for a trailer
+	return Merge(io.Discard, file, nil, func(v *options) { v.keepTrailer = o.keepTrailer || len(o.trailerMarkers) > 0 })
+}
+
+// Verifies the output at outPath, merged from the image at inPath, as far as the options call for it.
+func (o *options) verifyOutput(outPath, inPath string) error {
+	if o.verify {
+		err := verify(outPath, o)
+		if err != nil {
+			return fmt.Errorf("verifying output: %w", err)
+		}
+	}
+	if o.verifyScan {
+		err := verifyScan(outPath, inPath, o)
+		if err != nil {
+			return fmt.Errorf("verifying image data: %w", err)
+		}
+	}
+	return nil
 }
 
 // Reads the metadata from metadataImagePath
-// (which may be empty, in which case the metadata is tripped)
+// (which may be empty, in which case the metadata is stripped)
 // and everything else from imagePath, writing the result to outImagePath.
-func merge(outImagePath, imagePath, metadataImagePath string) error {
-    outFile, err := os.Create(outImagePath)
-    if err != nil { return err }
-    defer outFile.Close()
-    writer := bufio.NewWriter(outFile)
-
-    imageFile, err := os.Open(imagePath)
-    if err != nil { return err }
-    defer imageFile.Close()
-    imageReader := bufio.NewReader(imageFile)
-
-	_, err = writer.Write([]byte{0xFF, soi})
-	if err != nil { return err }
-	{
-		if metadataImagePath != "" {
-			// Copy metadata segments
-			// It seems that they need to come first!
-			metaFile, err := os.Open(metadataImagePath)
-	   		if err != nil { return err }
-	    	defer metaFile.Close()
-	    	metaReader := bufio.NewReader(metaFile)
-			err = copySegments(writer, metaReader, isMetaTagType)
-			if err != nil { return err }
-		}
-		// Copy all non-metadata segments
-		err = copySegments(writer, imageReader, func(tagType byte) bool {
-			return !isMetaTagType(tagType)
-		})
+// The result is written to a temporary file which is only renamed to outImagePath once complete
+// and, if check is not nil, checked by it, so outImagePath is never observed in a partial state.
+// The result gets the permissions (and, if requested, the modification time) of imagePath.
+func merge(ctx context.Context, outImagePath, imagePath, metadataImagePath string, opts []Option, check func(path string) error) (err error) {
+	outFile, err := createTemp(outImagePath)
+	if err != nil { return err }
+	defer func() {
+		if err != nil {
+			outFile.Close()
+			os.Remove(outFile.Name())
+		}
+	}()
+
+	imageFile, err := os.Open(imagePath)
+	if err != nil { return err }
+	defer imageFile.Close()
+	imageInfo, err := imageFile.Stat()
+	if err != nil { return err }
+
+	var metadata io.Reader
+	if metadataImagePath != "" {
+		metaFile, err := os.Open(metadataImagePath)
 		if err != nil { return err }
+		defer metaFile.Close()
+		metadata = metaFile
 	}
-	_, err = writer.Write([]byte{0xFF, eoi})
+	err = MergeContext(ctx, outFile, imageFile, metadata, opts...)
+	if err != nil { return err }
+	err = outFile.Sync()
 	if err != nil { return err }
+	err = outFile.Chmod(imageInfo.Mode().Perm())
+	if err != nil { return err }
+	err = outFile.Close()
+	if err != nil { return err }
+	if newOptions(opts).preserveTimes {
+		err = os.Chtimes(outFile.Name(), imageInfo.ModTime(), imageInfo.ModTime())
+		if err != nil { return err }
+	}
+	if check != nil {
+		err = check(outFile.Name())
+		if err != nil { return err }
+	}
+	return os.Rename(outFile.Name(), outImagePath)
+}
 
-    // Flush the writer, otherwise the last couple buffered writes (including the EOI) won't get written!
-    return writer.Flush()
+// Creates a new temporary file path.tmpN next to path.
+// Unlike os.CreateTemp, this uses the same permissions as os.Create.
+func createTemp(path string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(fmt.Sprintf("%s.tmp%d", path, rand.Uint32()), os.O_RDWR | os.O_CREATE | os.O_EXCL, 0o666)
+		if !errors.Is(err, fs.ErrExist) {
+			return file, err
+		}
+	}
 }
 
-// This does not decode JPEGs; it only parses and understands them at a segment level.
+// ErrJFIFAndEXIF is returned under WithStrict if the output would hold both a JFIF (APP0) and an EXIF (APP1) segment.
+// The two formats are strictly incompatible, since both require their segment to come first, and some decoders reject such files.
+var ErrJFIFAndEXIF = errors.New("output would hold both JFIF (APP0) and EXIF (APP1) segments")
 
-const (
-	soi = 0xD8
-	eoi = 0xD9
-	sos = 0xDA
-	app1 = 0xE1 // typically EXIF
-	app14 = 0xEE // typically copyright info
-	com = 0xFE
-)
+// ErrMPFTrailer is returned when the trailer of an image with an MPF segment would be stripped,
+// since it typically holds further images such as burst shots, depth maps or motion photos.
+// Use WithKeepTrailer to preserve them or WithForce to strip them anyways.
+var ErrMPFTrailer = errors.New("trailer holds images indexed by MPF, refusing to strip it")
+
+// ErrTooLarge is returned if an input exceeds the size given by WithMaxFileSize.
+var ErrTooLarge = errors.New("file too large")
 
-func isMetaTagType(tagType byte) bool {
-	return (tagType >= app1 && tagType <= app14) || tagType == com
+// sizeLimitReader fails with ErrTooLarge once more than the remaining bytes are read from r.
+type sizeLimitReader struct {
+	r io.Reader
+	remaining int64
 }
 
-func copySegments(dst *bufio.Writer, src *bufio.Reader, filterSegment func(tagType byte) bool) error {
-	var buf [2]byte
-	_, err := io.ReadFull(src, buf[:])
-	if err != nil { return err }
-	if buf != [2]byte{0xFF, soi} {
-		return errors.New("expected SOI")
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, ErrTooLarge
 	}
-	for {
-		_, err := io.ReadFull(src, buf[:])
+	return n, err
+}
+
+// Result describes what Merge did; see WithResult.
+// For formats other than JPEG, the markers are those of the equivalent JPEG segments, e.g. APP1 for EXIF chunks.
+type Result struct {
+	RemovedMarkers []byte // of the metadata segments removed from the image, in order, one per segment
+	AddedMarkers []byte // of the segments added from the metadata source (or for the comment), in order
+	RemovedBytes int // total length of the metadata segments removed from the image
+	LostICC bool // whether an ICC profile was removed from the image without the metadata source providing one
+	// EmptySource is whether there was a metadata source, but it held no metadata to copy,
+	// so that the image was stripped (or, under WithKeepIfEmptySource, kept its metadata).
+	EmptySource bool
+}
+
+// Merge reads the metadata from metadata
+// (which may be nil, in which case the metadata is stripped)
+// and everything else from image, writing the result to out.
+// Neither needs to be a file: Merge works on arbitrary readers and writers,
+// such as an HTTP request body and a bytes.Buffer.
+// The output is written through a buffer which is flushed before Merge returns.
+// If Merge fails, out may have received partial output, which the caller needs to discard;
+// ReplaceMetadata takes care of this by writing to a temporary file.
+func Merge(out io.Writer, image io.Reader, metadata io.Reader, opts ...Option) error {
+	return MergeContext(context.Background(), out, image, metadata, opts...)
+}
+
+// StripBytes returns image stripped of its metadata; see Merge.
+func StripBytes(image []byte, opts ...Option) ([]byte, error) {
+	return ReplaceBytes(image, nil, opts...)
+}
+
+// ReplaceBytes returns image with its metadata replaced with that of metadata
+// (which may be nil, in which case the metadata is stripped); see Merge.
+func ReplaceBytes(image, metadata []byte, opts ...Option) ([]byte, error) {
+	var metadataReader io.Reader
+	if metadata != nil {
+		metadataReader = bytes.NewReader(metadata)
+	}
+	var out bytes.Buffer
+	out.Grow(len(image))
+	err := Merge(&out, bytes.NewReader(image), metadataReader, opts...)
+	if err != nil { return nil, err }
+	return out.Bytes(), nil
+}
+
+// MergeContext is like Merge, but stops early with ctx.Err() if ctx is done,
+// which is checked at every segment boundary and periodically within entropy-coded data.
+func MergeContext(ctx context.Context, out io.Writer, image io.Reader, metadata io.Reader, opts ...Option) error {
+	o := newOptions(opts)
+	if o.maxFileSize > 0 {
+		image = &sizeLimitReader{r: image, remaining: o.maxFileSize}
+		if metadata != nil {
+			metadata = &sizeLimitReader{r: metadata, remaining: o.maxFileSize}
+		}
+	}
+	writer := o.newWriter(out)
+	imageReader := o.newReader(image)
+
+	if o.exif != nil {
+		if metadata != nil {
+			return errors.New("both a metadata source and EXIF given")
+		}
+		wrapped, err := wrapEXIF(o.exif)
+		if err != nil { return err }
+		metadata = bytes.NewReader(wrapped)
+	}
+	if o.keepIfEmptySource && metadata != nil {
+		data, err := io.ReadAll(metadata)
+		if err != nil { return err }
+		found, err := hasMetadata(data, o)
 		if err != nil { return err }
-		if buf[0] != 0xFF {
-			return errors.New("invalid tag type")
-		}
-		if buf[1] == eoi {
-			if !*stripTrailer {
-				// Hacky way to check for EOF
-				n, err := src.Read(buf[:1])
-				if err != nil && err != io.EOF { return err }
-				if n > 0 {
-					return errors.New("unexpected trailer")
-				}
+		metadata = bytes.NewReader(data)
+		if !found {
+			metadata, o.emptySource = nil, true
+			if o.logger != nil {
+				o.logger.Printf("warning: metadata source holds no metadata, keeping that of the image")
 			}
-			return nil
 		}
-		sos := buf[1] == 0xDA
-		filter := filterSegment(buf[1])
-		if filter {
-			_, err = dst.Write(buf[:])
-			if err != nil { return err }
+	}
+	o.stripping = metadata == nil && !o.emptySource
+	var logSummary func()
+	if o.logger != nil {
+		logSummary = o.logDecisions()
+	}
+	var result Result
+	var removedICC, addedICC, copied bool
+	if o.result != nil {
+		observe := o.observe
+		o.observe = func(seg *segment, fromMetadata, kept bool) {
+			if observe != nil {
+				observe(seg, fromMetadata, kept)
+			}
+			isICC := seg.marker == APP2 && seg.ident == "ICC"
+			switch {
+				case fromMetadata && kept:
+					result.AddedMarkers = append(result.AddedMarkers, seg.marker)
+					addedICC = addedICC || isICC
+					copied = copied || !seg.comment
+				case !fromMetadata && !kept:
+					result.RemovedMarkers = append(result.RemovedMarkers, seg.marker)
+					result.RemovedBytes += seg.length
+					removedICC = removedICC || isICC
+			}
 		}
+	}
+	format, err := DetectFormat(imageReader)
+	if err != nil { return err }
+	switch format {
+		case JPEG:
+			err = mergeJPEG(ctx, writer, imageReader, metadata, o)
+		case PNG:
+			err = mergePNG(ctx, writer, imageReader, metadata, o)
+		case WebP:
+			err = mergeWebP(ctx, writer, imageReader, metadata, o)
+		case TIFF:
+			err = mergeTIFF(ctx, writer, imageReader, metadata, o)
+	}
+	if err != nil { return err }
 
-		_, err = io.ReadFull(src, buf[:])
-		if err != nil { return err }
-		if filter {
-			_, err = dst.Write(buf[:])
-			if err != nil { return err }
-		}
+	// Flush the writer, otherwise the last couple buffered writes (including the EOI) won't get written!
+	err = writer.Flush()
+	if err != nil { return err }
+	if logSummary != nil {
+		logSummary()
+	}
+	if o.result != nil {
+		result.LostICC = removedICC && !addedICC
+		result.EmptySource = o.emptySource || (metadata != nil && !copied)
+		*o.result = result
+	}
+	return nil
+}
 
-		// Note: Includes the length, but not the tag, so subtract 2
-		tagLength := ((uint16(buf[0]) << 8) | uint16(buf[1])) - 2
-		if filter {
-			_, err = io.CopyN(dst, src, int64(tagLength))
-		} else {
-			_, err = src.Discard(int(tagLength))
+// Writes the metadata segments of the metadata source (if not nil; a JPEG, WebP or HEIF),
+// followed by the comment (if any),
+// and all non-metadata segments of the JPEG image to writer.
+// The metadata is placed after the leading APP0 segments of the image (JFIF), which are to come first,
+// unless the options place it first.
+func mergeJPEG(ctx context.Context, writer *bufio.Writer, imageReader *bufio.Reader, metadata io.Reader, o *options) error {
+	_, err := writer.Write([]byte{0xFF, SOI})
+	if err != nil { return err }
+	var jfif, exif bool
+	observe := o.observe
+	o.observe = func(seg *segment, fromMetadata, kept bool) {
+		if kept {
+			jfif = jfif || (seg.marker == APP0 && seg.ident == "JFIF")
+			exif = exif || (seg.marker == APP1 && seg.ident == "EXIF")
 		}
-		if err != nil { return err }
-		if sos {
-			// Find next tag `FF xx` (where `xx != 0` and `xx` isn't a restart marker) to skip ECS
-			for {
-				bytes, err := src.Peek(2)
+		if observe != nil {
+			observe(seg, fromMetadata, kept)
+		}
+	}
+	var trailer bytes.Buffer
+	var trailerWriter *bufio.Writer
+	if len(o.trailerMarkers) > 0 {
+		trailerWriter = bufio.NewWriter(&trailer)
+	}
+	insertMetadata := func() error {
+		if metadata != nil {
+			metaReader := o.newReader(metadata)
+			head, _ := metaReader.Peek(formatHeaderLength)
+			if isWebP(head) || isHEIF(head) {
+				err := writeMetadataSegments(ctx, writer, trailerWriter, metaReader, o)
 				if err != nil { return err }
-				if bytes[0] == 0xFF {
-					data, rstMrk := bytes[1] == 0, bytes[1] >= 0xD0 && bytes[1] <= 0xD7
-					if !data && !rstMrk {
-						break
-					}
-				}
-				if filter {
-					err = dst.WriteByte(bytes[0])
-					if err != nil { return err }
-				}
-				_, err = src.Discard(1)
+			} else {
+				metaWalker := &segmentWalker{ctx: ctx, src: metaReader, opts: o, fromMetadata: true, trailer: trailerWriter}
+				err := metaWalker.copySegments(writer, o.isMetadataSegment, nil)
 				if err != nil { return err }
 			}
 		}
+		if o.comment != "" {
+			if trailerWriter != nil && o.isTrailerMarker(COM) {
+				return writeComment(trailerWriter, o)
+			}
+			return writeComment(writer, o)
+		}
+		return nil
+	}
+	// Copy all non-metadata segments
+	imageWalker := &segmentWalker{ctx: ctx, src: imageReader, opts: o, insert: insertMetadata, trailer: trailerWriter}
+	if o.metadataFirst {
+		err = insertMetadata()
+		if err != nil { return err }
+		imageWalker.insert = nil
+	}
+	err = imageWalker.copySegments(writer, func(seg *segment) bool {
+		return !o.isMetadataSegment(seg)
+	}, nil)
+	if err != nil { return err }
+	if imageWalker.insert != nil {
+		// The image ended (without EOI) before any segment but APP0
+		err = insertMetadata()
+		if err != nil { return err }
+	}
+	if jfif && exif {
+		// JFIF and EXIF both require their segment to come right after SOI
+		if o.strict {
+			return ErrJFIFAndEXIF
+		}
+		if o.logger != nil {
+			o.logger.Printf("warning: both JFIF (APP0) and EXIF (APP1) segments present, which some decoders reject")
+		}
+	}
+	if imageWalker.mpf && o.stripTrailer && !o.keepTrailer {
+		// The trailer most likely holds the images indexed by MPF
+		_, err = imageReader.Peek(1)
+		if err == nil {
+			if !o.force {
+				return ErrMPFTrailer
+			}
+			if o.logger != nil {
+				o.logger.Printf("strip trailer holding MPF images")
+			}
+		}
+	}
+	_, err = writer.Write([]byte{0xFF, EOI})
+	if err != nil { return err }
+	if o.keepTrailer {
+		trailerLength, err := io.Copy(writer, imageReader)
+		if err != nil { return err }
+		if o.logger != nil && trailerLength > 0 {
+			o.logger.Printf("keep trailer from image (%d bytes)", trailerLength)
+		}
+	}
+	if trailerWriter != nil {
+		err = trailerWriter.Flush()
+		if err != nil { return err }
+		_, err = writer.Write(trailer.Bytes())
+		if err != nil { return err }
+		if o.logger != nil && trailer.Len() > 0 {
+			o.logger.Printf("write %d bytes of segments after EOI", trailer.Len())
+		}
+	}
+	return nil
+}
+
+// Hooks into the decisions on segments to log them to the logger of the options and count the removed ones,
+// returning a function which logs the count.
+func (o *options) logDecisions() (logSummary func()) {
+	observe := o.observe
+	var removedBytes, removedSegments int
+	o.observe = func(seg *segment, fromMetadata, kept bool) {
+		if observe != nil {
+			observe(seg, fromMetadata, kept)
+		}
+		var action, source string
+		switch {
+			case fromMetadata && kept:
+				action, source = "add", "metadata"
+			case fromMetadata:
+				action, source = "ignore", "metadata"
+			case kept:
+				action, source = "keep", "image"
+			default:
+				action, source = "drop", "image"
+				removedBytes += seg.length
+				removedSegments++
+		}
+		o.logger.Printf("%s %s from %s (%d bytes)", action, seg.displayName(), source, seg.length)
+	}
+	return func() {
+		o.logger.Printf("removed %d metadata bytes across %d segments", removedBytes, removedSegments)
 	}
 }
@@ -0,0 +1,485 @@
+package scrubbish
+
+import (
+	"os"
+	"io"
+	"bytes"
+	"flag"
+	"sync"
+	"errors"
+	"testing"
+	"path/filepath"
+	"encoding/binary"
+)
+
+var update = flag.Bool("update", false, "Write the outputs to the golden files in testdata instead of comparing them")
+
+// Returns a JPEG segment with the marker and payload.
+func jpegSegment(marker byte, payload []byte) []byte {
+	return append([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+}
+
+// testJPEG describes a synthetic grayscale JPEG without metadata. Its entropy-coded data is made up
+// rather than decodable, which is fine since scrubbish never decodes it.
+type testJPEG struct {
+	sof byte // SOF0 if zero
+	scans int // each preceded by its own DHT segment; 1 if zero
+	ecsLength int // of each scan, not counting stuffed bytes and restart markers
+	restartInterval int // if positive, a DRI segment is written and a restart marker follows every restartInterval bytes
+	dnl bool // whether the SOF leaves the number of lines to a DNL segment following the first scan
+}
+
+// Returns the JPEG.
+func (spec testJPEG) bytes() []byte {
+	sof, scans := spec.sof, spec.scans
+	if sof == 0 {
+		sof = SOF0
+	}
+	if scans == 0 {
+		scans = 1
+	}
+	var lines byte = 16
+	if spec.dnl {
+		lines = 0
+	}
+	jpeg := []byte{0xFF, SOI}
+	jpeg = append(jpeg, jpegSegment(DQT, append([]byte{0}, bytes.Repeat([]byte{1}, 64)...))...)
+	jpeg = append(jpeg, jpegSegment(sof, []byte{8, 0, lines, 0, 16, 1, 1, 0x11, 0})...) // 16 pixels wide, one component
+	if spec.restartInterval > 0 {
+		jpeg = append(jpeg, jpegSegment(DRI, []byte{0, 1})...)
+	}
+	for scan := 0; scan < scans; scan++ {
+		jpeg = append(jpeg, jpegSegment(DHT, append([]byte{byte(scan)}, make([]byte, 16)...))...)
+		jpeg = append(jpeg, jpegSegment(SOS, []byte{1, 1, 0, 0, 63, 0})...)
+		jpeg = append(jpeg, entropyCodedData(spec.ecsLength, spec.restartInterval, scan)...)
+		if spec.dnl && scan == 0 {
+			jpeg = append(jpeg, jpegSegment(DNL, []byte{0, 16})...)
+		}
+	}
+	return append(jpeg, 0xFF, EOI)
+}
+
+// Returns n bytes of made-up entropy-coded data, varying with seed, with every 0xFF stuffed and,
+// if restartInterval is positive, a restart marker (cycling through RST0-RST7) after every restartInterval bytes.
+func entropyCodedData(n, restartInterval, seed int) []byte {
+	var data []byte
+	for i := 0; i < n; i++ {
+		b := byte(i * 31 + seed * 7)
+		data = append(data, b)
+		if b == 0xFF {
+			data = append(data, 0) // stuffed
+		}
+		if restartInterval > 0 && i % restartInterval == restartInterval - 1 && i < n - 1 {
+			data = append(data, 0xFF, RST0 + byte(i / restartInterval % 8))
+		}
+	}
+	return data
+}
+
+// Returns the JPEG with the segments inserted right after its SOI.
+func withSegments(jpeg []byte, segments ...[]byte) []byte {
+	out := append([]byte(nil), jpeg[:2]...)
+	for _, seg := range segments {
+		out = append(out, seg...)
+	}
+	return append(out, jpeg[2:]...)
+}
+
+// Returns an EXIF segment in the byte order, holding the orientation and a GPS IFD with the GPS version.
+func exifSegment(order binary.ByteOrder) []byte {
+	tiff := make([]byte, 56)
+	copy(tiff, "II")
+	if order == binary.BigEndian {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8) // IFD0
+	order.PutUint16(tiff[8:], 2)
+	entry := func(at int, tag, typ uint16, count uint32) {
+		order.PutUint16(tiff[at:], tag)
+		order.PutUint16(tiff[at + 2:], typ)
+		order.PutUint32(tiff[at + 4:], count)
+	}
+	entry(10, tagOrientation, 3, 1)
+	order.PutUint16(tiff[18:], 6)
+	entry(22, tagGPSIFD, 4, 1)
+	order.PutUint32(tiff[30:], 38)
+	order.PutUint16(tiff[38:], 1)
+	entry(40, 0x0000, 1, 4) // GPS version
+	copy(tiff[48:], []byte{2, 3, 0, 0})
+	return jpegSegment(APP1, append([]byte(exifHeader), tiff...))
+}
+
+// Returns an APP2 segment holding a made-up ICC profile in a single chunk.
+func iccSegment() []byte {
+	return jpegSegment(APP2, append([]byte("ICC_PROFILE\x00\x01\x01"), bytes.Repeat([]byte("icc"), 40)...))
+}
+
+// Returns an APP13 segment holding made-up IPTC data.
+func iptcSegment() []byte {
+	return jpegSegment(APP13, []byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00\x00\x00\x00\x00"))
+}
+
+// Returns a COM segment.
+func commentSegment(comment string) []byte {
+	return jpegSegment(COM, []byte(comment))
+}
+
+// Compares the output to the golden file testdata/name.jpg, writing the golden file instead under -update.
+func checkGolden(t *testing.T, name string, output []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name + ".jpg")
+	if *update {
+		err := os.WriteFile(path, output, 0o666)
+		if err != nil { t.Fatal(err) }
+	}
+	golden, err := os.ReadFile(path)
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(output, golden) {
+		t.Errorf("output (%d bytes) differs from %s (%d bytes); run go test -update to accept it", len(output), path, len(golden))
+	}
+}
+
+func TestMergeGolden(t *testing.T) {
+	image := testJPEG{ecsLength: 200}.bytes()
+	progressive := testJPEG{sof: SOF2, scans: 3, ecsLength: 100}.bytes()
+	metadata := [][]byte{exifSegment(binary.LittleEndian), iccSegment(), commentSegment("image")}
+	donor := withSegments(testJPEG{ecsLength: 50}.bytes(), exifSegment(binary.BigEndian), iptcSegment(), commentSegment("donor"))
+	trailer := []byte("trailing data")
+	for _, test := range []struct {
+		name string
+		image, metadata []byte
+		opts []Option
+	}{
+		{"strip", withSegments(image, metadata...), nil, nil},
+		{"copy", withSegments(image, metadata...), donor, nil},
+		{"copy-into-clean", image, donor, nil},
+		{"strip-trailer", append(withSegments(image, metadata...), trailer...), nil, []Option{WithStripTrailer(true)}},
+		{"keep-trailer", append(withSegments(image, metadata...), trailer...), nil, []Option{WithKeepTrailer()}},
+		{"copy-keep-trailer", append(withSegments(image, metadata...), trailer...), append(donor, trailer...), []Option{WithKeepTrailer()}},
+		{"strip-comments", withSegments(image, commentSegment("first"), commentSegment("second")), nil, nil},
+		{"keep-comments", withSegments(image, metadata...), nil, []Option{WithKeep(COM)}},
+		{"add-comment", withSegments(image, metadata...), donor, []Option{WithComment("added")}},
+		{"progressive-strip", withSegments(progressive, metadata...), nil, nil},
+		{"progressive-copy", withSegments(progressive, metadata...), donor, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var metadata io.Reader
+			if test.metadata != nil {
+				metadata = bytes.NewReader(test.metadata)
+			}
+			var output bytes.Buffer
+			err := Merge(&output, bytes.NewReader(test.image), metadata, test.opts...)
+			if err != nil { t.Fatal(err) }
+			checkGolden(t, test.name, output.Bytes())
+		})
+	}
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failingWriter accepts the first n bytes written to it, failing afterwards with a short write.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errWriteFailed
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestMergeWriteFailure(t *testing.T) {
+	image := withSegments(testJPEG{ecsLength: 1000, restartInterval: 100}.bytes(), exifSegment(binary.LittleEndian))
+	donor := withSegments(testJPEG{ecsLength: 10}.bytes(), iccSegment(), commentSegment("donor"))
+	for _, metadata := range [][]byte{nil, donor} {
+		output, err := ReplaceBytes(image, metadata)
+		if err != nil { t.Fatal(err) }
+		for _, n := range []int{0, 1, 3, 100, len(output) / 2, len(output) - 1} {
+			for _, bufferSize := range []int{16, defaultBufferSize} {
+				var metadataReader io.Reader
+				if metadata != nil {
+					metadataReader = bytes.NewReader(metadata)
+				}
+				err = Merge(&failingWriter{n: n}, bytes.NewReader(image), metadataReader, WithBufferSize(bufferSize))
+				if !errors.Is(err, errWriteFailed) {
+					t.Errorf("failing after %d of %d bytes with %d byte buffers: got %v", n, len(output), bufferSize, err)
+				}
+			}
+		}
+	}
+}
+
+// Returns the names of the files in the directory.
+func readDirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil { t.Fatal(err) }
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestReplaceMetadataFailure(t *testing.T) {
+	// The output is partially written before the truncation is noticed
+	image := withSegments(testJPEG{ecsLength: 10000}.bytes(), exifSegment(binary.LittleEndian))
+	truncated := image[:len(image) - 100]
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.jpg")
+	err := os.WriteFile(path, truncated, 0o666)
+	if err != nil { t.Fatal(err) }
+	for _, opts := range [][]Option{nil, {WithInPlace()}} {
+		err = ReplaceMetadata(path, "", opts...)
+		parseError(t, err)
+		content, err := os.ReadFile(path)
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(content, truncated) {
+			t.Errorf("destination changed")
+		}
+		if names := readDirNames(t, dir); len(names) != 1 {
+			t.Errorf("left behind %v", names)
+		}
+	}
+	err = MergeFiles(filepath.Join(dir, "out.jpg"), path, "")
+	parseError(t, err)
+	if names := readDirNames(t, dir); len(names) != 1 {
+		t.Errorf("left behind %v", names)
+	}
+}
+
+func TestTrailerOptionPerCall(t *testing.T) {
+	image := testJPEG{ecsLength: 100}.bytes()
+	trailer := []byte("trailing data")
+	withTrailer := append(withSegments(image, commentSegment("comment")), trailer...)
+	for i := 0; i < 3; i++ {
+		stripped, err := StripBytes(withTrailer, WithStripTrailer(true))
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(stripped, image) {
+			t.Errorf("trailer not stripped")
+		}
+		_, err = StripBytes(withTrailer)
+		if parseError(t, err).Kind != "unexpected trailer" {
+			t.Errorf("got %v, want an unexpected trailer", err)
+		}
+		kept, err := StripBytes(withTrailer, WithKeepTrailer())
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(kept, append(image[:len(image):len(image)], trailer...)) {
+			t.Errorf("trailer not kept")
+		}
+		_, err = StripBytes(withTrailer, WithStripTrailer(false))
+		if parseError(t, err).Kind != "unexpected trailer" {
+			t.Errorf("got %v, want an unexpected trailer", err)
+		}
+	}
+}
+
+func TestConcurrentMerges(t *testing.T) {
+	image := append(withSegments(testJPEG{ecsLength: 5000, restartInterval: 100}.bytes(), exifSegment(binary.LittleEndian), iccSegment(), commentSegment("image")), "trailer"...)
+	donor := withSegments(testJPEG{ecsLength: 10}.bytes(), exifSegment(binary.BigEndian), iptcSegment())
+	cases := []struct {
+		metadata []byte
+		opts []Option
+	}{
+		{nil, []Option{WithStripTrailer(true)}},
+		{nil, []Option{WithKeepTrailer()}},
+		{nil, []Option{WithStripTrailer(true), WithKeep(COM), WithBufferSize(16)}},
+		{nil, []Option{WithStripTrailer(true), WithStripGPS()}},
+		{donor, []Option{WithKeepTrailer(), WithComment("concurrent")}},
+		{donor, []Option{WithStripTrailer(true), WithStrip(APP1)}},
+	}
+	// The results of sequential merges
+	expected := make([][]byte, len(cases))
+	for i, c := range cases {
+		var err error
+		expected[i], err = ReplaceBytes(image, c.metadata, c.opts...)
+		if err != nil { t.Fatal(err) }
+	}
+	var wg sync.WaitGroup
+	for round := 0; round < 20; round++ {
+		for i := range cases {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				c := cases[i]
+				var output bytes.Buffer
+				var metadata io.Reader
+				if c.metadata != nil {
+					metadata = bytes.NewReader(c.metadata)
+				}
+				err := Merge(&output, bytes.NewReader(image), metadata, c.opts...)
+				if err != nil {
+					t.Errorf("case %d: %v", i, err)
+				} else if !bytes.Equal(output.Bytes(), expected[i]) {
+					t.Errorf("case %d: output differs from that of a sequential merge", i)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+}
+
+// Reports throughput as the bytes of image and metadata source read per second;
+// since reading the source stops at its first scan, a large source mostly goes unread.
+func BenchmarkMerge(b *testing.B) {
+	metadata := [][]byte{exifSegment(binary.LittleEndian), iccSegment(), commentSegment("benchmark")}
+	for _, bench := range []struct {
+		name string
+		spec testJPEG
+		donor *testJPEG // if not nil, the metadata is copied from it rather than stripped
+	}{
+		{"100KB", testJPEG{ecsLength: 100 << 10, restartInterval: 4096}, nil},
+		{"5MB", testJPEG{ecsLength: 5 << 20, restartInterval: 4096}, nil},
+		{"100MB", testJPEG{ecsLength: 100 << 20, restartInterval: 4096}, nil},
+		{"progressive-5MB", testJPEG{sof: SOF2, scans: 10, ecsLength: 512 << 10, restartInterval: 4096}, nil},
+		{"replace-100KB-from-100MB", testJPEG{ecsLength: 100 << 10, restartInterval: 4096}, &testJPEG{ecsLength: 100 << 20, restartInterval: 4096}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			image := withSegments(bench.spec.bytes(), metadata...)
+			var donor []byte
+			if bench.donor != nil {
+				donor = withSegments(bench.donor.bytes(), metadata...)
+			}
+			for _, buffer := range []struct {
+				name string
+				opts []Option
+			}{
+				{"default-buffer", nil},
+				{"1MB-buffer", []Option{WithBufferSize(1 << 20)}},
+			} {
+				b.Run(buffer.name, func(b *testing.B) {
+					b.SetBytes(int64(len(image) + len(donor)))
+					for i := 0; i < b.N; i++ {
+						var source io.Reader
+						if donor != nil {
+							source = bytes.NewReader(donor)
+						}
+						err := Merge(io.Discard, bytes.NewReader(image), source, buffer.opts...)
+						if err != nil { b.Fatal(err) }
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	jfif := jpegSegment(APP0, []byte("JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00"))
+	xmp := jpegSegment(APP1, []byte(xmpHeader + "<x:xmpmeta/>"))
+	image := withSegments(testJPEG{ecsLength: 1000, restartInterval: 100}.bytes(), jfif, exifSegment(binary.LittleEndian), xmp, iccSegment(), iptcSegment(), commentSegment("image"))
+	donor := withSegments(testJPEG{ecsLength: 10}.bytes(), exifSegment(binary.BigEndian), iccSegment(), commentSegment("donor"))
+	for _, metadata := range [][]byte{nil, donor} {
+		for _, opts := range [][]Option{nil, {WithStripGPS()}, {WithKeep(APP2)}, {WithComment("added")}, {WithKeepXMP()}} {
+			once, err := ReplaceBytes(image, metadata, opts...)
+			if err != nil { t.Fatal(err) }
+			twice, err := ReplaceBytes(once, metadata, opts...)
+			if err != nil { t.Fatal(err) }
+			if !bytes.Equal(once, twice) {
+				t.Errorf("merging again (source given: %v, %d options) changed the output", metadata != nil, len(opts))
+			}
+		}
+	}
+}
+
+func TestDonorOrder(t *testing.T) {
+	image := testJPEG{ecsLength: 100}.bytes()
+	segments := map[byte][]byte{APP1: exifSegment(binary.LittleEndian), APP2: iccSegment(), APP13: iptcSegment(), COM: commentSegment("donor")}
+	for _, order := range [][]byte{{APP1, APP2, APP13, COM}, {COM, APP13, APP2, APP1}} {
+		var donor [][]byte
+		for _, marker := range order {
+			donor = append(donor, segments[marker])
+		}
+		for _, test := range []struct {
+			opts []Option
+			copied func(marker byte) bool
+		}{
+			{nil, func(byte) bool { return true }},
+			{[]Option{WithKeep(APP2)}, func(marker byte) bool { return marker != APP2 }},
+			{[]Option{WithStrip(APP1, APP13, COM)}, func(marker byte) bool { return marker != APP2 }},
+			{[]Option{WithStrip(APP2, COM)}, func(marker byte) bool { return marker == APP2 || marker == COM }},
+		} {
+			var want []byte
+			for _, marker := range order {
+				if test.copied(marker) {
+					want = append(want, marker)
+				}
+			}
+			output, err := ReplaceBytes(image, withSegments(image, donor...), test.opts...)
+			if err != nil { t.Fatal(err) }
+			var got []byte
+			err = Walk(bytes.NewReader(output), func(seg Segment) error {
+				if isMetaTagType(seg.Marker) {
+					got = append(got, seg.Marker)
+				}
+				return nil
+			})
+			if err != nil { t.Fatal(err) }
+			if !bytes.Equal(got, want) {
+				t.Errorf("donor order % X: output order % X, want % X", order, got, want)
+			}
+		}
+	}
+}
+
+func TestValidateICC(t *testing.T) {
+	image := testJPEG{ecsLength: 100}.bytes()
+	chunk := func(seq, count byte) []byte {
+		return jpegSegment(APP2, append(append([]byte("ICC_PROFILE\x00"), seq, count), "icc"...))
+	}
+	_, err := ReplaceBytes(image, withSegments(image, chunk(1, 2), chunk(2, 2)), WithValidateICC())
+	if err != nil { t.Fatal(err) }
+	for _, test := range []struct {
+		name string
+		chunks [][]byte
+		kind string
+	}{
+		{"past the declared count", [][]byte{chunk(1, 2), chunk(2, 2), chunk(3, 2)}, "invalid ICC profile chunk"},
+		{"mismatched count", [][]byte{chunk(1, 2), chunk(2, 3)}, "invalid ICC profile chunk count"},
+		{"missing", [][]byte{chunk(1, 2)}, "incomplete ICC profile"},
+		{"reordered", [][]byte{chunk(2, 2), chunk(1, 2)}, "invalid ICC profile chunk"},
+	} {
+		_, err = ReplaceBytes(image, withSegments(image, test.chunks...), WithValidateICC())
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		} else if parseError(t, err).Kind != test.kind {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.kind)
+		}
+	}
+	// The offset is that of the offending chunk
+	chunks := [][]byte{chunk(1, 2), chunk(2, 2), chunk(3, 2)}
+	_, err = ReplaceBytes(image, withSegments(image, chunks...), WithValidateICC())
+	if offset := int64(2 + len(chunks[0]) + len(chunks[1])); err == nil || parseError(t, err).Offset != offset {
+		t.Errorf("got %v, want it at offset %d", err, offset)
+	}
+}
+
+func TestKeepIfEmptySource(t *testing.T) {
+	image := testJPEG{ecsLength: 100}.bytes()
+	input := withSegments(image, exifSegment(binary.LittleEndian))
+	donor := testJPEG{ecsLength: 50}.bytes()
+	var result Result
+	var out bytes.Buffer
+	err := Merge(&out, bytes.NewReader(input), bytes.NewReader(donor), WithResult(&result))
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(out.Bytes(), image) {
+		t.Errorf("output (%d bytes) differs from the stripped image (%d bytes)", out.Len(), len(image))
+	}
+	if !result.EmptySource {
+		t.Errorf("EmptySource not set")
+	}
+	result = Result{}
+	out.Reset()
+	err = Merge(&out, bytes.NewReader(input), bytes.NewReader(donor), WithResult(&result), WithKeepIfEmptySource())
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(out.Bytes(), input) {
+		t.Errorf("output (%d bytes) differs from the input (%d bytes)", out.Len(), len(input))
+	}
+	if !result.EmptySource || len(result.RemovedMarkers) > 0 {
+		t.Errorf("got %+v, want an empty source and nothing removed", result)
+	}
+}
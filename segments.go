@@ -0,0 +1,494 @@
+package scrubbish
+
+import (
+	"io"
+	"bytes"
+	"context"
+	"bufio"
+	"fmt"
+	"unicode/utf8"
+	"crypto/sha256"
+	"compress/zlib"
+)
+
+// This does not decode JPEGs; it only parses and understands them at a segment level.
+// Nothing depends on the coding process: Baseline, extended (12-bit), progressive, lossless, arithmetic
+// and hierarchical JPEGs share the segment syntax and the byte stuffing of the entropy-coded data.
+
+func isMetaTagType(tagType byte) bool {
+	return (tagType >= APP1 && tagType <= APP14) || tagType == COM
+}
+
+// Reports whether the marker stands alone, without a length or payload.
+// Besides SOI and EOI, these are TEM and the restart markers RST0-RST7.
+// Restart markers usually only occur within entropy-coded data, but are tolerated between segments.
+func isStandalone(marker byte) bool {
+	return marker == TEM || isRestart(marker)
+}
+
+// Reports whether the marker is one of the restart markers RST0-RST7.
+func isRestart(marker byte) bool {
+	return marker >= RST0 && marker <= RST7
+}
+
+// Reports whether the marker is reserved rather than assigned by the JPEG standard: 0x00 (which only occurs
+// as a stuffed data byte), RES (0x02-0xBF), JPG (0xC8) and JPG0-JPG13 (0xF0-0xFD, used by extensions like JPEG-LS).
+// Like all markers but the standalone ones, reserved markers are assumed to start segments with a length,
+// which are copied as they are unless the options are strict.
+func isReserved(marker byte) bool {
+	return (marker < SOF0 && marker != TEM) || marker == JPG || (marker >= 0xF0 && marker <= 0xFD)
+}
+
+// Reports whether the marker starts a frame (SOF0-SOF15).
+// DHT, JPG and DAC share the range of SOF markers but are not SOF markers.
+func isSOF(marker byte) bool {
+	return marker >= SOF0 && marker <= SOF15 && marker != DHT && marker != JPG && marker != DAC
+}
+
+// Reports whether the SOF marker starts a differential frame (SOF5-SOF7, SOF13-SOF15),
+// which only occurs in hierarchical JPEGs.
+func isDifferential(marker byte) bool {
+	return isSOF(marker) && marker & 0x07 >= 5
+}
+
+// segment describes a segment as encountered while walking a JPEG.
+type segment struct {
+	marker byte
+	offset int64 // of the 0xFF preceding the marker
+	length int // as declared, including the two length bytes; 0 for standalone markers
+	ident string // identifier of APPn segments as named by appIdentifiers, e.g. "JFIF" or "EXIF", if known
+	ecsLength int64 // length of the entropy-coded data following an SOS segment
+	payload []byte // if the walker reads payloads and the segment was not copied, or if the options filter by payload
+	name string // of the equivalent chunk, for formats other than JPEG
+	comment bool // whether the segment holds the comment of the options rather than being read from an input
+}
+
+// Returns the name of the segment for display, e.g. "APP1" or, for other formats, the chunk name.
+func (seg *segment) displayName() string {
+	if seg.name != "" {
+		return seg.name
+	}
+	return markerName(seg.marker)
+}
+
+// Number of bytes of entropy-coded data after which cancellation is checked
+const ctxCheckInterval = 1 << 16
+
+// segmentWalker walks the segments of a JPEG, keeping track of the offset.
+type segmentWalker struct {
+	ctx context.Context
+	src *bufio.Reader
+	opts *options
+	fromMetadata bool // whether src is the metadata source rather than the image
+	offset int64 // of the next byte to be read from src
+	readPayloads bool // whether to read the payloads of segments which are not copied rather than discarding them
+	icc iccChecker // of the copied ICC profile chunks, if the options call for it
+	mpf bool // whether an MPF segment, which indexes images appended after the EOI, has been seen
+	copied map[[sha256.Size]byte]bool // hashes of the copied metadata segments, if the options call for deduplication
+	metadataBytes int64 // total length of the segments copied from the metadata source
+	// insert, if not nil, is called once before the first segment which isn't APP0, to write further segments
+	insert func() error
+	trailer *bufio.Writer // if not nil, copied segments with the trailer markers of the options are written here instead
+}
+
+// Returns where to write a copied segment with the marker to: dst, or the trailer if the segment is relocated there.
+func (w *segmentWalker) destination(dst *bufio.Writer, marker byte) *bufio.Writer {
+	if w.trailer != nil && w.opts.isTrailerMarker(marker) {
+		return w.trailer
+	}
+	return dst
+}
+
+// Reports whether a segment with the marker and payload has been copied before, if the options call for deduplication.
+func (w *segmentWalker) isDuplicate(marker byte, payload []byte) bool {
+	if !w.fromMetadata || !w.opts.dedup {
+		return false
+	}
+	hash := sha256.New()
+	hash.Write([]byte{marker})
+	hash.Write(payload)
+	var sum [sha256.Size]byte
+	hash.Sum(sum[:0])
+	if w.copied[sum] {
+		return true
+	}
+	if w.copied == nil {
+		w.copied = map[[sha256.Size]byte]bool{}
+	}
+	w.copied[sum] = true
+	return false
+}
+
+// Reports the decision on a segment to the observer of the options, if any.
+func (w *segmentWalker) decided(seg *segment, kept bool) {
+	if w.opts.observe != nil {
+		w.opts.observe(seg, w.fromMetadata, kept)
+	}
+}
+
+// Copies the segments for which filterSegment returns true from w.src to dst,
+// rewriting their payloads where the options call for it.
+// If seen is not nil, it is called for every segment after it has been consumed.
+func (w *segmentWalker) copySegments(dst *bufio.Writer, filterSegment func(seg *segment) bool, seen func(seg segment) error) error {
+	src := w.src
+	var buf [2]byte
+	// Errors will surface as a short head
+	head, _ := src.Peek(formatHeaderLength)
+	if len(head) < 2 || head[0] != 0xFF || head[1] != SOI {
+		return notJPEG(head)
+	}
+	_, err := src.Discard(2)
+	if err != nil { return err }
+	if seen != nil {
+		err = seen(segment{marker: SOI, offset: w.offset})
+		if err != nil { return err }
+	}
+	w.offset += 2
+	for {
+		err = w.ctx.Err()
+		if err != nil { return err }
+		marker, err := w.readMarker()
+		if err == io.EOF {
+			if w.opts.repairEOI {
+				return w.missingEOI()
+			}
+			return &ParseError{Offset: w.offset, Kind: "missing EOI", Msg: "(truncated at a segment boundary)"}
+		}
+		if err == io.ErrUnexpectedEOF {
+			return &ParseError{Offset: w.offset, Kind: "truncated marker"}
+		}
+		if err != nil { return err }
+		seg := segment{marker: marker, offset: w.offset - 2}
+		if w.insert != nil && seg.marker != APP0 {
+			err = w.insert()
+			if err != nil { return err }
+			w.insert = nil
+		}
+		if w.opts.strict && isReserved(seg.marker) {
+			return &ParseError{Offset: seg.offset, Kind: "reserved marker", Msg: markerName(seg.marker)}
+		}
+		if seg.marker == SOI {
+			// SOI has no length; reading one would misinterpret whatever follows
+			return &ParseError{Offset: seg.offset, Kind: "unexpected SOI"}
+		}
+		if seg.marker == EOI {
+			err = w.end()
+			if err != nil { return err }
+			if seen != nil {
+				err = seen(seg)
+				if err != nil { return err }
+			}
+			// Trailers of the metadata source are irrelevant, since only its metadata is copied
+			if !w.fromMetadata && !w.opts.stripTrailer && !w.opts.keepTrailer {
+				// Hacky way to check for EOF
+				n, err := src.Read(buf[:1])
+				if err != nil && err != io.EOF { return err }
+				if n > 0 {
+					return &ParseError{Offset: w.offset, Kind: "unexpected trailer"}
+				}
+			}
+			return nil
+		}
+		if isStandalone(seg.marker) {
+			filter := filterSegment(&seg)
+			if filter {
+				_, err = dst.Write([]byte{0xFF, seg.marker})
+				if err != nil { return err }
+			}
+			w.decided(&seg, filter)
+			if seen != nil {
+				err = seen(seg)
+				if err != nil { return err }
+			}
+			continue
+		}
+		isScan := seg.marker == SOS
+		if isScan && w.fromMetadata {
+			// Metadata segments precede the first scan, so there's no need to read the rest of the metadata source
+			return w.end()
+		}
+
+		_, err = io.ReadFull(src, buf[:])
+		if err != nil { return truncated(&seg, err) }
+
+		// Note: Includes the length, but not the tag, so subtract 2
+		declaredLength := (uint16(buf[0]) << 8) | uint16(buf[1])
+		if declaredLength < 2 {
+			return &ParseError{Offset: seg.offset, Kind: "invalid segment length", Msg: fmt.Sprintf("%d of %s", declaredLength, markerName(seg.marker))}
+		}
+		tagLength := declaredLength - 2
+		seg.length = int(tagLength) + 2
+		var head []byte
+		if seg.marker >= APP0 && seg.marker <= APP15 {
+			peekLength := int(tagLength)
+			if peekLength > maxIdentLength {
+				peekLength = maxIdentLength
+			}
+			// Errors will surface when consuming the payload
+			head, _ = src.Peek(peekLength)
+			seg.ident = appIdentifier(head)
+			if seg.ident == "MPF" {
+				w.mpf = true
+			}
+		}
+		// The filter of the options may need the payload to decide
+		buffered := w.opts.needsPayload(seg.marker)
+		if buffered {
+			seg.payload = make([]byte, tagLength)
+			_, err = io.ReadFull(src, seg.payload)
+			if err != nil { return truncated(&seg, err) }
+			head = seg.payload[:len(head)]
+		}
+		filter := filterSegment(&seg)
+		if filter && w.fromMetadata {
+			err = w.opts.countMetadata(&seg, &w.metadataBytes)
+			if err != nil { return err }
+		}
+		if filter && w.opts.validateICC && seg.marker == APP2 && seg.ident == "ICC" {
+			err = w.icc.chunk(&seg, head)
+			if err != nil { return err }
+		}
+		if filter && (w.opts.rewritesSegment(&seg) || (w.fromMetadata && w.opts.dedup)) {
+			payload := seg.payload
+			if !buffered {
+				payload = make([]byte, tagLength)
+				_, err = io.ReadFull(src, payload)
+				if err != nil { return truncated(&seg, err) }
+			}
+			if w.opts.rewritesSegment(&seg) {
+				payload, err = w.opts.rewriteSegment(&seg, payload)
+				if err != nil { return err }
+			}
+			if payload != nil && !w.isDuplicate(seg.marker, payload) {
+				err = writeSegment(w.destination(dst, seg.marker), seg.marker, payload)
+			} else {
+				filter = false
+			}
+		} else if filter {
+			out := w.destination(dst, seg.marker)
+			_, err = out.Write([]byte{0xFF, seg.marker, buf[0], buf[1]})
+			if err != nil { return err }
+			if buffered {
+				_, err = out.Write(seg.payload)
+			} else {
+				_, err = io.CopyN(out, src, int64(tagLength))
+			}
+		} else if buffered {
+			// The payload has been read already
+		} else if w.readPayloads {
+			seg.payload = make([]byte, tagLength)
+			_, err = io.ReadFull(src, seg.payload)
+		} else {
+			_, err = src.Discard(int(tagLength))
+		}
+		if err != nil { return truncated(&seg, err) }
+		w.decided(&seg, filter)
+		w.offset += int64(seg.length)
+		if isScan {
+			// Every scan is followed by its own ECS. Progressive JPEGs have several scans,
+			// possibly with tables in between; each SOS is handled by its own iteration.
+			err = w.skipECS(dst, filter, &seg)
+			if err != nil { return err }
+			w.offset += seg.ecsLength
+		}
+		if seen != nil {
+			err = seen(seg)
+			if err != nil { return err }
+		}
+	}
+}
+
+// Returns ErrNotJPEG for input starting with head rather than SOI, naming its format if it is well-known,
+// so that passing the wrong kind of file is told apart from a corrupt JPEG, which is a ParseError.
+func notJPEG(head []byte) error {
+	if name := describeFormat(head); name != "" {
+		return fmt.Errorf("%w: %s", ErrNotJPEG, name)
+	}
+	if len(head) == 0 {
+		return fmt.Errorf("%w: empty input", ErrNotJPEG)
+	}
+	if len(head) > 2 {
+		head = head[:2]
+	}
+	return fmt.Errorf("%w: expected SOI, got %X", ErrNotJPEG, head)
+}
+
+// Reads the next marker, dropping any number of 0xFF fill bytes preceding it.
+// Afterwards, the offset is that of the byte following the marker, whose 0xFF is at the offset minus 2.
+func (w *segmentWalker) readMarker() (byte, error) {
+	var buf [2]byte
+	_, err := io.ReadFull(w.src, buf[:])
+	if err != nil { return 0, err }
+	if buf[0] != 0xFF {
+		return 0, &ParseError{Offset: w.offset, Kind: "invalid tag type", Msg: fmt.Sprintf("0x%02X", buf[0])}
+	}
+	w.offset += 2
+	for buf[1] == 0xFF {
+		buf[1], err = w.src.ReadByte()
+		if err != nil { return 0, err }
+		w.offset++
+	}
+	return buf[1], nil
+}
+
+// Copies (if keep is true) or skips the entropy-coded data following an SOS segment, counting its length.
+// The data ends at the next marker `FF xx` where `xx` is neither 0 (a stuffed 0xFF data byte) nor a restart marker;
+// restart markers and their fill bytes are part of the data.
+func (w *segmentWalker) skipECS(dst *bufio.Writer, keep bool, seg *segment) error {
+	src := w.src
+	nextCheck := int64(ctxCheckInterval)
+	for {
+		if seg.ecsLength >= nextCheck {
+			err := w.ctx.Err()
+			if err != nil { return err }
+			nextCheck += ctxCheckInterval
+		}
+		// Process the buffered data up to the next 0xFF at once
+		n := src.Buffered()
+		if n == 0 {
+			n = 1
+		}
+		data, err := src.Peek(n)
+		if len(data) == 0 {
+			if err == io.EOF && w.opts.repairEOI {
+				// The ECS is truncated; keep what is there
+				return nil
+			}
+			return w.truncatedECS(seg, err)
+		}
+		n = bytes.IndexByte(data, 0xFF)
+		if n < 0 {
+			n = len(data)
+		} else if n == 0 {
+			// Restart markers, like all markers, may be preceded by fill bytes
+			i := 1
+			for {
+				data, err = src.Peek(i + 1)
+				if len(data) <= i || data[i] != 0xFF {
+					break
+				}
+				i++
+			}
+			if err == bufio.ErrBufferFull {
+				return nil // too many fill bytes to look past; leave them to readMarker
+			}
+			if len(data) <= i {
+				// Keep the final bytes of a truncated ECS
+				if err != io.EOF || !w.opts.repairEOI { return w.truncatedECS(seg, err) }
+			} else if data[i] != 0 && !isRestart(data[i]) {
+				return nil
+			}
+			n = len(data)
+		}
+		if keep {
+			_, err = dst.Write(data[:n])
+			if err != nil { return err }
+		}
+		_, err = src.Discard(n)
+		if err != nil { return err }
+		seg.ecsLength += int64(n)
+	}
+}
+
+// Turns the input ending within the segment into a ParseError.
+func truncated(seg *segment, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &ParseError{Offset: seg.offset, Kind: "truncated segment", Msg: markerName(seg.marker)}
+	}
+	return err
+}
+
+// Like truncated, but for the input ending within the entropy-coded data following the SOS segment.
+func (w *segmentWalker) truncatedECS(seg *segment, err error) error {
+	if err == io.EOF {
+		return &ParseError{Offset: w.offset + seg.ecsLength, Kind: "truncated entropy-coded data"}
+	}
+	return err
+}
+
+// Runs the checks due at the end of the JPEG.
+func (w *segmentWalker) end() error {
+	if w.opts.validateICC {
+		return w.icc.done()
+	}
+	return nil
+}
+
+// Handles the input ending at a segment boundary or within entropy-coded data rather than with an EOI,
+// which is tolerated if the options call for repairing it: Merge appends an EOI anyways.
+func (w *segmentWalker) missingEOI() error {
+	err := w.end()
+	if err != nil { return err }
+	if w.opts.logger != nil && !w.fromMetadata {
+		w.opts.logger.Printf("appended missing EOI at offset 0x%X", w.offset)
+	}
+	return nil
+}
+
+// Writes a segment with the given marker and payload.
+func writeSegment(dst *bufio.Writer, marker byte, payload []byte) error {
+	length := len(payload) + 2
+	if len(payload) > maxPayloadLength {
+		return fmt.Errorf("%s segment too long: %d bytes", markerName(marker), length)
+	}
+	_, err := dst.Write([]byte{0xFF, marker, byte(length >> 8), byte(length)})
+	if err != nil { return err }
+	_, err = dst.Write(payload)
+	return err
+}
+
+// Maximum length of a segment payload, since the length includes the two length bytes
+const maxPayloadLength = 0xFFFF - 2
+
+// Writes the comment of the options as COM segments; see writeCommentSegments.
+func writeComment(dst *bufio.Writer, o *options) error {
+	if o.observe == nil {
+		return writeCommentSegments(dst, []byte(o.comment), nil)
+	}
+	return writeCommentSegments(dst, []byte(o.comment), func(seg *segment, fromMetadata, kept bool) {
+		seg.comment = true
+		o.observe(seg, fromMetadata, kept)
+	})
+}
+
+// Writes the comment as COM segments, splitting it (at UTF-8 character boundaries)
+// if it is too long for a single segment, and reports them to observe, if not nil.
+func writeCommentSegments(dst *bufio.Writer, comment []byte, observe func(seg *segment, fromMetadata, kept bool)) error {
+	for len(comment) > 0 {
+		n := len(comment)
+		if n > maxPayloadLength {
+			n = maxPayloadLength
+			for n > 0 && !utf8.RuneStart(comment[n]) {
+				n--
+			}
+		}
+		err := writeSegment(dst, COM, comment[:n])
+		if err != nil { return err }
+		if observe != nil {
+			observe(&segment{marker: COM, length: n + 2}, true, true)
+		}
+		comment = comment[n:]
+	}
+	return nil
+}
+
+// Maximum length of an inflated comment, to bound the memory used by zlib bombs
+const maxInflatedCommentLength = 1 << 20
+
+// Inflates the payload of a COM segment if it is zlib-compressed, as some tools do,
+// reporting whether it was. Payloads which merely look like zlib streams are left alone.
+func inflateComment(payload []byte) ([]byte, bool) {
+	// The zlib header: deflate with a window of at most 32 KiB, and a check value making it a multiple of 31
+	if len(payload) < 2 || payload[0] & 0x0F != 8 || payload[0] >> 4 > 7 || (uint(payload[0]) << 8 | uint(payload[1])) % 31 != 0 {
+		return payload, false
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return payload, false
+	}
+	inflated, err := io.ReadAll(io.LimitReader(reader, maxInflatedCommentLength + 1))
+	if err != nil || len(inflated) > maxInflatedCommentLength {
+		return payload, false
+	}
+	return inflated, true
+}
@@ -0,0 +1,291 @@
+package scrubbish
+
+import (
+	"io"
+	"fmt"
+	"bytes"
+	"errors"
+	"time"
+	"context"
+	"testing"
+	"encoding/binary"
+)
+
+// Maximum time to spend on a fuzzed input before considering the parser hung
+const fuzzTimeout = 10 * time.Second
+
+func FuzzCopySegments(f *testing.F) {
+	image := testJPEG{ecsLength: 100}.bytes()
+	withMetadata := withSegments(image, exifSegment(binary.BigEndian), iccSegment(), iptcSegment(), commentSegment("seed"))
+	for _, seed := range [][]byte{
+		image,
+		withMetadata,
+		testJPEG{sof: SOF2, scans: 3, ecsLength: 50}.bytes(),
+		testJPEG{ecsLength: 100, restartInterval: 10}.bytes(),
+		testJPEG{ecsLength: 100, dnl: true}.bytes(),
+		append(withMetadata[:len(withMetadata):len(withMetadata)], "trailer"...),
+		// Malformed
+		nil,
+		{0xFF, SOI},
+		{0xFF, SOI, 0xFF, APP1, 0x00, 0x00},
+		{0xFF, SOI, 0xFF, SOI, 0xFF, EOI},
+		withMetadata[:len(withMetadata) / 2],
+		image[:len(image) - 2],
+		withSegments(image, []byte{0xFF, 0xFF, 0xFF, RST3, 0x42}),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ctx, cancel := context.WithTimeout(context.Background(), fuzzTimeout)
+		defer cancel()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			var stripped bytes.Buffer
+			err := MergeContext(ctx, &stripped, bytes.NewReader(data), nil, WithStripTrailer(true))
+			if err == nil {
+				// The output must re-parse, and there must be nothing left to strip
+				var again bytes.Buffer
+				err = Merge(&again, bytes.NewReader(stripped.Bytes()), nil)
+				if err != nil {
+					t.Errorf("stripped output doesn't re-parse: %v", err)
+				} else if !bytes.Equal(again.Bytes(), stripped.Bytes()) {
+					t.Errorf("stripping the stripped output changed it")
+				}
+			}
+			var replaced bytes.Buffer
+			err = MergeContext(ctx, &replaced, bytes.NewReader(image), bytes.NewReader(data))
+			if err == nil {
+				err = Merge(io.Discard, bytes.NewReader(replaced.Bytes()), nil)
+				if err != nil {
+					t.Errorf("output with the metadata of the input doesn't re-parse: %v", err)
+				}
+			}
+		}()
+		select {
+			case <-done:
+			case <-time.After(fuzzTimeout + time.Second):
+				t.Fatalf("hung on %d bytes of input", len(data))
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("took longer than %v on %d bytes of input", fuzzTimeout, len(data))
+		}
+	})
+}
+
+// Strips the metadata segments from the image, with small and default buffers,
+// checking that the output is the image without them, byte for byte.
+func checkStripped(t *testing.T, image []byte, metadata ...[]byte) {
+	t.Helper()
+	for _, opts := range [][]Option{nil, {WithBufferSize(16)}} {
+		var stripped bytes.Buffer
+		err := Merge(&stripped, bytes.NewReader(withSegments(image, metadata...)), nil, opts...)
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(stripped.Bytes(), image) {
+			t.Errorf("stripped output (%d bytes) differs from the image without metadata (%d bytes)", stripped.Len(), len(image))
+		}
+	}
+}
+
+// Returns the segments of the JPEG with the marker, as passed to Walk.
+func walkSegments(t *testing.T, jpeg []byte, marker byte) []Segment {
+	t.Helper()
+	var segments []Segment
+	err := Walk(bytes.NewReader(jpeg), func(seg Segment) error {
+		if seg.Marker == marker {
+			segments = append(segments, seg)
+		}
+		return nil
+	})
+	if err != nil { t.Fatal(err) }
+	return segments
+}
+
+func TestProgressiveScans(t *testing.T) {
+	for _, spec := range []testJPEG{
+		{sof: SOF2, scans: 5, ecsLength: 1000},
+		{sof: SOF2, scans: 5, ecsLength: 1000, restartInterval: 100},
+	} {
+		image := spec.bytes()
+		checkStripped(t, image, exifSegment(binary.LittleEndian), commentSegment("progressive"))
+		scans := walkSegments(t, image, SOS)
+		if len(scans) != spec.scans {
+			t.Fatalf("%d scans, want %d", len(scans), spec.scans)
+		}
+		for i, scan := range scans {
+			ecsLength := int64(len(entropyCodedData(spec.ecsLength, spec.restartInterval, i)))
+			if scan.ECSLength != ecsLength {
+				t.Errorf("scan %d: ECS of %d bytes, want %d", i, scan.ECSLength, ecsLength)
+			}
+		}
+	}
+}
+
+func TestRestartMarkers(t *testing.T) {
+	image := testJPEG{ecsLength: 1000, restartInterval: 50}.bytes()
+	for marker := byte(RST0); marker <= RST7; marker++ {
+		if !bytes.Contains(image, []byte{0xFF, marker}) {
+			t.Fatalf("image lacks %s", MarkerName(marker))
+		}
+	}
+	// Markers may be preceded by any number of 0xFF fill bytes
+	withFill := bytes.ReplaceAll(image, []byte{0xFF, RST2}, []byte{0xFF, 0xFF, RST2})
+	withFill = bytes.ReplaceAll(withFill, []byte{0xFF, RST5}, []byte{0xFF, 0xFF, 0xFF, 0xFF, RST5})
+	for _, image := range [][]byte{image, withFill} {
+		checkStripped(t, image, exifSegment(binary.BigEndian), iccSegment())
+		scans := walkSegments(t, image, SOS)
+		if len(scans) != 1 {
+			t.Fatalf("%d scans, want 1", len(scans))
+		}
+		// The restart markers are part of the entropy-coded data, which ends right before the EOI
+		ecsStart := scans[0].Offset + int64(scans[0].Length) + 2
+		if ecsStart + scans[0].ECSLength != int64(len(image) - 2) {
+			t.Errorf("ECS of %d bytes ends at offset %d, want it to end at the EOI", scans[0].ECSLength, ecsStart + scans[0].ECSLength)
+		}
+	}
+}
+
+func TestDNL(t *testing.T) {
+	image := testJPEG{scans: 2, ecsLength: 500, dnl: true}.bytes()
+	checkStripped(t, image, exifSegment(binary.LittleEndian), commentSegment("dnl"))
+	segments := walkSegments(t, image, DNL)
+	if len(segments) != 1 || segments[0].Length != 4 || !bytes.Equal(segments[0].Payload, []byte{0, 16}) {
+		t.Fatalf("DNL segments %+v, want one holding 16 lines", segments)
+	}
+	// The image goes on after the DNL
+	if scans := walkSegments(t, image, SOS); len(scans) != 2 {
+		t.Errorf("%d scans, want 2", len(scans))
+	}
+	if end := walkSegments(t, image, EOI); len(end) != 1 || end[0].Offset != int64(len(image) - 2) {
+		t.Errorf("EOI %+v, want it at the end of the image", end)
+	}
+}
+
+// Returns the *ParseError err is or wraps, failing the test if there is none.
+func parseError(t *testing.T, err error) *ParseError {
+	t.Helper()
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("got %v, want a *ParseError", err)
+	}
+	return parseErr
+}
+
+func TestInvalidSegmentLength(t *testing.T) {
+	image := testJPEG{ecsLength: 100}.bytes()
+	for _, length := range []byte{0, 1} {
+		// Preceded by a valid segment, so that the offset is not that of the first segment
+		corrupt := withSegments(image, commentSegment("valid"), []byte{0xFF, APP1, 0x00, length})
+		offset := int64(2 + len(commentSegment("valid")))
+		_, err := StripBytes(corrupt)
+		parseErr := parseError(t, err)
+		if parseErr.Kind != "invalid segment length" || parseErr.Offset != offset || parseErr.Msg != fmt.Sprintf("%d of APP1", length) {
+			t.Errorf("got %q at offset %d, want an invalid length of APP1 at offset %d", parseErr.Error(), parseErr.Offset, offset)
+		}
+		// Also in the metadata source
+		_, err = ReplaceBytes(image, corrupt)
+		parseErr = parseError(t, err)
+		if parseErr.Offset != offset {
+			t.Errorf("got %q in the metadata source, want it at offset %d", parseErr.Error(), offset)
+		}
+	}
+}
+
+func TestFrameTypes(t *testing.T) {
+	for _, sof := range []byte{SOF1, SOF3, SOF9, SOF10, SOF11} {
+		t.Run(MarkerName(sof), func(t *testing.T) {
+			image := testJPEG{sof: sof, ecsLength: 1000, restartInterval: 100}.bytes()
+			checkStripped(t, image, exifSegment(binary.BigEndian), iccSegment(), commentSegment(MarkerName(sof)))
+			err := Validate(bytes.NewReader(image))
+			if err != nil { t.Fatal(err) }
+			if frames := walkSegments(t, image, sof); len(frames) != 1 {
+				t.Errorf("%d frames, want 1", len(frames))
+			}
+		})
+	}
+	// Differential frames only occur in hierarchical JPEGs, which start with a DHP segment
+	_, err := StripBytes(testJPEG{sof: SOF7, ecsLength: 100}.bytes())
+	if err != nil { t.Fatal(err) }
+	err = Validate(bytes.NewReader(testJPEG{sof: SOF7, ecsLength: 100}.bytes()))
+	if parseError(t, err).Kind != "differential SOF without DHP" {
+		t.Errorf("got %v, want a differential SOF without DHP", err)
+	}
+}
+
+func TestDoubledSOI(t *testing.T) {
+	image := testJPEG{ecsLength: 100}.bytes()
+	doubled := append([]byte{0xFF, SOI}, image...)
+	var output bytes.Buffer
+	err := Merge(&output, bytes.NewReader(doubled), nil)
+	parseErr := parseError(t, err)
+	if parseErr.Kind != "unexpected SOI" || parseErr.Offset != 2 {
+		t.Errorf("got %v, want an unexpected SOI at offset 2", err)
+	}
+	if output.Len() > 0 {
+		t.Errorf("wrote %d bytes", output.Len())
+	}
+	err = Validate(bytes.NewReader(doubled))
+	if parseError(t, err).Kind != "unexpected SOI" {
+		t.Errorf("got %v, want an unexpected SOI", err)
+	}
+}
+
+func TestTruncatedAfterAPP1(t *testing.T) {
+	exif := exifSegment(binary.LittleEndian)
+	truncated := withSegments([]byte{0xFF, SOI}, exif)
+	_, err := StripBytes(truncated)
+	parseErr := parseError(t, err)
+	if parseErr.Kind != "missing EOI" || parseErr.Offset != int64(len(truncated)) {
+		t.Errorf("got %v, want a missing EOI at offset %d", err, len(truncated))
+	}
+	// Repairing appends the EOI
+	for _, test := range []struct {
+		opts []Option
+		want []byte
+	}{
+		{[]Option{WithRepairEOI()}, []byte{0xFF, SOI, 0xFF, EOI}},
+		{[]Option{WithRepairEOI(), WithKeep(APP1)}, append(truncated[:len(truncated):len(truncated)], 0xFF, EOI)},
+	} {
+		repaired, err := StripBytes(truncated, test.opts...)
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(repaired, test.want) {
+			t.Errorf("repaired to % X, want % X", repaired, test.want)
+		}
+	}
+	// Truncation within the payload is told apart, naming the segment, whether the payload is copied, rewritten or skipped
+	image := testJPEG{ecsLength: 100}.bytes()
+	withinPayload := truncated[:len(truncated) - 10]
+	for _, opts := range [][]Option{nil, {WithKeep(APP1)}, {WithStripGPS()}, {WithFilter(func(byte, []byte) bool { return true }), WithFilterPayloads()}} {
+		_, err = StripBytes(withinPayload, opts...)
+		parseErr = parseError(t, err)
+		if parseErr.Kind != "truncated segment" || parseErr.Msg != "APP1" || parseErr.Offset != 2 {
+			t.Errorf("got %v, want a truncated APP1 at offset 2", err)
+		}
+	}
+	for _, opts := range [][]Option{nil, {WithDedup()}, {WithStripGPS()}} {
+		_, err = ReplaceBytes(image, withinPayload, opts...)
+		if parseError(t, err).Kind != "truncated segment" {
+			t.Errorf("got %v in the metadata source, want a truncated segment", err)
+		}
+	}
+}
+
+func TestRestartInterval(t *testing.T) {
+	image := testJPEG{ecsLength: 2000, restartInterval: 64}.bytes()
+	checkStripped(t, image, exifSegment(binary.LittleEndian), iccSegment(), commentSegment("dri"))
+	for _, opts := range [][]Option{nil, {WithStrip(APP1, APP2, COM)}, {WithStripGPS()}} {
+		stripped, err := StripBytes(withSegments(image, exifSegment(binary.BigEndian)), opts...)
+		if err != nil { t.Fatal(err) }
+		dri := walkSegments(t, stripped, DRI)
+		if len(dri) != 1 || !bytes.Equal(dri[0].Payload, []byte{0, 1}) {
+			t.Errorf("DRI segments %+v, want the one of the image", dri)
+		}
+		restarts := 0
+		for marker := byte(RST0); marker <= RST7; marker++ {
+			restarts += bytes.Count(stripped, []byte{0xFF, marker})
+		}
+		if restarts != (2000 - 1) / 64 {
+			t.Errorf("%d restart markers, want %d", restarts, (2000 - 1) / 64)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package scrubbish
+
+import (
+	"io"
+	"context"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"encoding/binary"
+)
+
+// TIFF images share their structure with EXIF payloads (see exif.go): The IFDs describe the pages of the image,
+// whose pixels live in strips or tiles pointed to by the IFD entries. Metadata lives in IFD entries as well:
+// The EXIF and GPS IFDs, descriptive baseline tags such as the make, model and artist,
+// XMP, ICC profiles, IPTC data, and a few private tags such as maker notes. These are treated like the equivalent JPEG segments:
+// EXIF (including GPS and the descriptive tags) and XMP like APP1, ICC profiles like APP2, IPTC data like APP13,
+// and the private metadata tags like APP1 segments of unknown kind. Everything else, including other private tags
+// such as those of GeoTIFF, is structural and always kept.
+
+const (
+	tagImageDescription = 0x010E
+	tagMake = 0x010F
+	tagModel = 0x0110
+	tagStripOffsets = 0x0111
+	tagStripByteCounts = 0x0117
+	tagFreeOffsets = 0x0120
+	tagSoftware = 0x0131
+	tagDateTime = 0x0132
+	tagArtist = 0x013B
+	tagHostComputer = 0x013C
+	tagTileOffsets = 0x0144
+	tagTileByteCounts = 0x0145
+	tagSubIFDs = 0x014A
+	tagXMP = 0x02BC
+	tagCopyright = 0x8298
+	tagIPTC = 0x83BB
+	tagPhotoshop = 0x8649
+	tagICCProfile = 0x8773
+	tagXPTitle = 0x9C9B
+	tagXPComment = 0x9C9C
+	tagXPAuthor = 0x9C9D
+	tagXPKeywords = 0x9C9E
+	tagXPSubject = 0x9C9F
+	tagPrintIM = 0xC4A5
+)
+
+// Reports whether head, the first bytes of a file, is the header of a TIFF file.
+func isTIFF(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*"))
+}
+
+// Returns the JPEG segment equivalent to the TIFF entry, so that the options apply to both alike,
+// and whether the entry holds metadata at all.
+func (entry *tiffEntry) segment() (segment, bool) {
+	seg := segment{length: entry.size(), name: fmt.Sprintf("tag 0x%04X", entry.tag)}
+	switch entry.tag {
+		case tagExifIFD, tagGPSIFD, tagImageDescription, tagMake, tagModel, tagSoftware, tagDateTime,
+				tagArtist, tagHostComputer, tagCopyright:
+			seg.marker, seg.ident = APP1, "EXIF"
+		case tagXMP:
+			seg.marker, seg.ident = APP1, "XMP"
+		case tagICCProfile:
+			seg.marker, seg.ident = APP2, "ICC"
+		case tagIPTC, tagPhotoshop:
+			seg.marker, seg.ident = APP13, "IPTC"
+		case tagMakerNote, tagXPTitle, tagXPComment, tagXPAuthor, tagXPKeywords, tagXPSubject, tagPrintIM:
+			seg.marker = APP1
+		default:
+			return seg, false
+	}
+	return seg, true
+}
+
+// Returns the size of the value of the entry, including the IFD it points to, if any.
+func (entry *tiffEntry) size() int {
+	if entry.sub == nil {
+		return len(entry.value)
+	}
+	w := &tiffWriter{order: binary.BigEndian}
+	w.writeIFD(entry.sub)
+	return w.buf.Len()
+}
+
+// Returns the values of an entry of unsigned integers.
+func (entry *tiffEntry) uints(order binary.ByteOrder) ([]uint32, bool) {
+	var values []uint32
+	switch entry.typ {
+		case 3:
+			for i := 0; i + 2 <= len(entry.value); i += 2 {
+				values = append(values, uint32(order.Uint16(entry.value[i:])))
+			}
+		case 4:
+			for i := 0; i + 4 <= len(entry.value); i += 4 {
+				values = append(values, order.Uint32(entry.value[i:]))
+			}
+		default:
+			return nil, false
+	}
+	return values, true
+}
+
+// Converts the value of the entry (and of the IFD it points to) from one byte order to another.
+func (entry *tiffEntry) convert(from, to binary.ByteOrder) {
+	if from == to {
+		return
+	}
+	size := int(tiffTypeSizes[entry.typ])
+	if entry.typ == 5 || entry.typ == 10 {
+		size = 4 // rationals are pairs of longs
+	}
+	value := append([]byte(nil), entry.value...)
+	for i := 0; i + size <= len(value); i += size {
+		switch size {
+			case 2:
+				to.PutUint16(value[i:], from.Uint16(value[i:]))
+			case 4:
+				to.PutUint32(value[i:], from.Uint32(value[i:]))
+			case 8:
+				to.PutUint64(value[i:], from.Uint64(value[i:]))
+		}
+	}
+	entry.value = value
+	if entry.sub != nil {
+		for _, sub := range entry.sub.entries {
+			sub.convert(from, to)
+		}
+	}
+}
+
+// Like rewriteSegment, but for an entry of the EXIF group of a TIFF for which rewritesSegment returned true.
+// Returns whether the entry is kept and whether it was modified.
+func (o *options) rewriteTIFFEntry(entry *tiffEntry) (keep, modified bool) {
+	if o.inventory != nil {
+		o.inventory.GPS = o.inventory.GPS || entry.tag == tagGPSIFD
+		return true, false
+	}
+	if !o.stripsEXIFTags() {
+		// The orientation is a structural tag which is kept anyways
+		return false, false
+	}
+	if o.stripGPS && entry.tag == tagGPSIFD {
+		return false, false
+	}
+	if o.redactDates && entry.tag == tagDateTime {
+		entry.redactDate()
+		return true, true
+	}
+	if entry.tag == tagExifIFD && entry.sub != nil {
+		if o.stripMakerNote {
+			modified = entry.sub.remove(tagMakerNote)
+		}
+		if o.redactDates {
+			modified = entry.sub.redactDates() || modified
+		}
+	}
+	return true, modified
+}
+
+// Reads the strips (or tiles) of a TIFF image, so that they can be laid out anew when the IFD is written.
+// The offsets are turned into longs, as the new offsets may not fit shorts.
+func (ifd *tiffIFD) loadStrips(data []byte, order binary.ByteOrder) error {
+	offsetsEntry, countsEntry := ifd.entry(tagStripOffsets), ifd.entry(tagStripByteCounts)
+	if offsetsEntry == nil {
+		offsetsEntry, countsEntry = ifd.entry(tagTileOffsets), ifd.entry(tagTileByteCounts)
+	}
+	if offsetsEntry == nil {
+		return nil
+	}
+	if countsEntry == nil { return errTIFF }
+	offsets, ok := offsetsEntry.uints(order)
+	if !ok { return errTIFF }
+	counts, ok := countsEntry.uints(order)
+	if !ok || len(counts) != len(offsets) { return errTIFF }
+	ifd.strips = make([][]byte, len(offsets))
+	for i, offset := range offsets {
+		if uint64(offset) + uint64(counts[i]) > uint64(len(data)) { return errTIFF }
+		ifd.strips[i] = data[offset:offset + counts[i]]
+	}
+	offsetsEntry.typ = 4
+	offsetsEntry.value = make([]byte, 4*len(offsets))
+	return nil
+}
+
+// Like mergeJPEG, but for TIFF images. The metadata source may be a TIFF, a JPEG or a WebP.
+// Metadata is taken from the first IFD of the metadata source and added to the first IFD of the image.
+// Unlike JPEGs, TIFF images are read into memory as a whole. If nothing changes, the image is copied verbatim;
+// otherwise, the TIFF structure is laid out anew.
+func mergeTIFF(ctx context.Context, out *bufio.Writer, image *bufio.Reader, metadata io.Reader, o *options) error {
+	if o.comment != "" {
+		return errors.New("TIFF images can't hold comments")
+	}
+	data, err := io.ReadAll(image)
+	if err != nil { return err }
+	t, err := parseTIFF(data)
+	if err != nil {
+		return &ParseError{Offset: 0, Kind: "invalid TIFF structure"}
+	}
+	changed := false
+	for _, ifd := range t.ifds {
+		err = ctx.Err()
+		if err != nil { return err }
+		if ifd.entry(tagSubIFDs) != nil || ifd.entry(tagFreeOffsets) != nil {
+			return errors.New("TIFF images with SubIFDs or free space aren't supported")
+		}
+		err = ifd.loadStrips(data, t.order)
+		if err != nil {
+			return &ParseError{Offset: 0, Kind: "invalid TIFF structure", Msg: "(bad strips or tiles)"}
+		}
+		var kept []*tiffEntry
+		for _, entry := range ifd.entries {
+			seg, isMetadata := entry.segment()
+			keep := !isMetadata || !o.isMetadataSegment(&seg)
+			if keep && isMetadata && o.rewritesSegment(&seg) {
+				var modified bool
+				keep, modified = o.rewriteTIFFEntry(entry)
+				changed = changed || modified
+			}
+			if o.observe != nil {
+				o.observe(&seg, false, keep)
+			}
+			if keep {
+				kept = append(kept, entry)
+			} else {
+				changed = true
+			}
+		}
+		ifd.entries = kept
+	}
+	if metadata != nil && len(t.ifds) > 0 {
+		added, err := tiffMetadata(ctx, o.newReader(metadata), t.order, o)
+		if err != nil { return err }
+		ifd := t.ifds[0]
+		for _, entry := range added {
+			ifd.remove(entry.tag)
+			ifd.entries = append(ifd.entries, entry)
+			changed = true
+		}
+		sort.SliceStable(ifd.entries, func(i, j int) bool { return ifd.entries[i].tag < ifd.entries[j].tag })
+	}
+	if !changed {
+		_, err = out.Write(data)
+		return err
+	}
+	_, err = out.Write(t.bytes())
+	return err
+}
+
+// Reads the metadata entries to be copied from the first IFD of a TIFF, JPEG or WebP metadata source,
+// converting JPEG segments to the equivalent TIFF entries and all values to the given byte order.
+func tiffMetadata(ctx context.Context, metadata *bufio.Reader, order binary.ByteOrder, o *options) ([]*tiffEntry, error) {
+	head, _ := metadata.Peek(4)
+	if isTIFF(head) {
+		data, err := io.ReadAll(metadata)
+		if err != nil { return nil, err }
+		t, err := parseTIFF(data)
+		if err != nil {
+			return nil, &ParseError{Offset: 0, Kind: "invalid TIFF structure"}
+		}
+		if len(t.ifds) == 0 {
+			return nil, nil
+		}
+		var added []*tiffEntry
+		var copied int64
+		for _, entry := range t.ifds[0].entries {
+			seg, isMetadata := entry.segment()
+			add := isMetadata && o.isMetadataSegment(&seg)
+			if add && o.rewritesSegment(&seg) {
+				add, _ = o.rewriteTIFFEntry(entry)
+			}
+			if o.observe != nil {
+				o.observe(&seg, true, add)
+			}
+			if add {
+				err = o.countMetadata(&seg, &copied)
+				if err != nil { return nil, err }
+				entry.convert(t.order, order)
+				added = append(added, entry)
+			}
+		}
+		return added, nil
+	}
+	items, err := readMetadataItems(ctx, metadata, o)
+	if err != nil { return nil, err }
+	var added []*tiffEntry
+	for i := range items {
+		item := &items[i]
+		add := true
+		switch item.kind {
+			case "EXIF":
+				var exif *tiff
+				exif, err = parseTIFF(item.data)
+				if err != nil { return nil, err }
+				if len(exif.ifds) == 0 {
+					break
+				}
+				for _, entry := range exif.ifds[0].entries {
+					if seg, _ := entry.segment(); seg.ident == "EXIF" {
+						entry.convert(exif.order, order)
+						added = append(added, entry)
+					}
+				}
+			case "XMP":
+				added = append(added, &tiffEntry{tag: tagXMP, typ: 1, count: uint32(len(item.data)), value: item.data})
+			case "ICC":
+				added = append(added, &tiffEntry{tag: tagICCProfile, typ: 7, count: uint32(len(item.data)), value: item.data})
+			default:
+				add = false
+		}
+		if o.observe != nil {
+			o.observe(&item.seg, true, add)
+		}
+	}
+	return added, nil
+}
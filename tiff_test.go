@@ -0,0 +1,36 @@
+package scrubbish
+
+import (
+	"fmt"
+	"testing"
+	"encoding/binary"
+)
+
+func TestTIFFGeoTags(t *testing.T) {
+	order := binary.LittleEndian
+	pixels := make([]byte, 16*16)
+	ifd := &tiffIFD{entries: []*tiffEntry{
+		shortEntry(order, 0x0100, 16), // width
+		shortEntry(order, 0x0101, 16), // height
+		longEntry(order, tagStripOffsets, 0),
+		{tag: tagMake, typ: 2, count: 7, value: []byte("Camera\x00")},
+		longEntry(order, tagStripByteCounts, uint32(len(pixels))),
+		{tag: 0x830E, typ: 12, count: 3, value: make([]byte, 3*8)}, // ModelPixelScale
+		{tag: 0x8482, typ: 12, count: 6, value: make([]byte, 6*8)}, // ModelTiepoint
+		{tag: 0x87AF, typ: 3, count: 4, value: []byte{1, 0, 1, 0, 0, 0, 0, 0}}, // GeoKeyDirectory
+		{tag: tagXPComment, typ: 1, count: 4, value: []byte("h\x00i\x00")},
+	}, strips: [][]byte{pixels}}
+	image := (&tiff{order: order, ifds: []*tiffIFD{ifd}}).bytes()
+	stripped, err := StripBytes(image)
+	if err != nil { t.Fatal(err) }
+	parsed, err := parseTIFF(stripped)
+	if err != nil { t.Fatal(err) }
+	var tags []uint16
+	for _, entry := range parsed.ifds[0].entries {
+		tags = append(tags, entry.tag)
+	}
+	want := []uint16{0x0100, 0x0101, tagStripOffsets, tagStripByteCounts, 0x830E, 0x8482, 0x87AF}
+	if fmt.Sprint(tags) != fmt.Sprint(want) {
+		t.Errorf("stripped TIFF holds tags %X, want %X", tags, want)
+	}
+}
@@ -0,0 +1,61 @@
+package scrubbish
+
+import (
+	"io"
+	"context"
+	"bufio"
+)
+
+// Validate checks that the segments of the JPEG read from r appear in a valid order:
+// A single SOI at the start, a frame (SOF) before any scan (SOS), only one frame
+// (unless the JPEG is hierarchical), differential frames only in hierarchical JPEGs,
+// DNL only after the first scan, and at least one scan before EOI.
+// Trailing data after EOI is an error as well. If the order is invalid, the error is a *ParseError.
+// Validate only reads r; it does not decode the image.
+func Validate(r io.Reader) error {
+	walker := &segmentWalker{ctx: context.Background(), src: bufio.NewReader(r), opts: &options{}}
+	var v orderValidator
+	return walker.copySegments(nil, func(*segment) bool { return false }, v.check)
+}
+
+// orderValidator is a state machine checking the order of segments.
+type orderValidator struct {
+	hierarchical bool // whether a DHP segment has been seen, which allows several frames
+	frame bool // whether an SOF segment has been seen
+	scan bool // whether an SOS segment has been seen
+}
+
+func (v *orderValidator) check(seg segment) error {
+	fail := func(kind string) error {
+		return &ParseError{Offset: seg.offset, Kind: kind}
+	}
+	switch {
+		case seg.marker == DHP:
+			if v.frame {
+				return fail("DHP after SOF")
+			}
+			v.hierarchical = true
+		case isSOF(seg.marker):
+			if isDifferential(seg.marker) && !v.hierarchical {
+				return fail("differential SOF without DHP")
+			}
+			if v.frame && !v.hierarchical {
+				return fail("duplicate SOF")
+			}
+			v.frame = true
+		case seg.marker == SOS:
+			if !v.frame {
+				return fail("SOS before SOF")
+			}
+			v.scan = true
+		case seg.marker == DNL:
+			if !v.scan {
+				return fail("DNL before SOS")
+			}
+		case seg.marker == EOI:
+			if !v.scan {
+				return fail("EOI before SOS")
+			}
+	}
+	return nil
+}
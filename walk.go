@@ -0,0 +1,34 @@
+package scrubbish
+
+import (
+	"io"
+	"context"
+	"bufio"
+)
+
+// Segment describes a segment of a JPEG as passed to the callback of Walk.
+type Segment struct {
+	Marker byte // e.g. APP1; see MarkerName
+	Offset int64 // of the 0xFF preceding the marker
+	Length int // as declared, including the two length bytes; 0 for SOI, EOI, TEM and RSTn
+	Identifier string // of APPn segments, e.g. "JFIF" or "EXIF", if known
+	Payload []byte // excluding the length bytes
+	ECSLength int64 // length of the entropy-coded data following an SOS segment
+}
+
+// Walk calls fn for every segment of the JPEG read from r, in order, from SOI to EOI.
+// The entropy-coded data following SOS segments is skipped; trailing data after EOI is ignored.
+// Walk stops at the first error, returning it; malformed input results in a *ParseError.
+func Walk(r io.Reader, fn func(seg Segment) error) error {
+	walker := &segmentWalker{ctx: context.Background(), src: bufio.NewReader(r), opts: &options{stripTrailer: true}, readPayloads: true}
+	return walker.copySegments(nil, func(*segment) bool { return false }, func(seg segment) error {
+		return fn(Segment{
+			Marker: seg.marker,
+			Offset: seg.offset,
+			Length: seg.length,
+			Identifier: seg.ident,
+			Payload: seg.payload,
+			ECSLength: seg.ecsLength,
+		})
+	})
+}
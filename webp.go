@@ -0,0 +1,281 @@
+package scrubbish
+
+import (
+	"io"
+	"context"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"encoding/binary"
+)
+
+// WebP files are RIFF containers: "RIFF", the little-endian size of the rest of the file, "WEBP", and chunks,
+// each consisting of a FourCC, the little-endian size of the payload, and the payload (padded to an even length).
+// Metadata lives in ICCP, EXIF and "XMP " chunks, which require a VP8X chunk (the extended format)
+// whose flags announce them. The ICCP chunk comes right after VP8X; EXIF and XMP come last.
+
+const webpHeaderLength = 12
+
+// Reports whether head, the first bytes of a file, is the header of a WebP file.
+func isWebP(head []byte) bool {
+	return len(head) >= webpHeaderLength && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP"
+}
+
+// Flags of the VP8X chunk
+const (
+	vp8xICC = 0x20
+	vp8xAlpha = 0x10
+	vp8xEXIF = 0x08
+	vp8xXMP = 0x04
+)
+
+type riffChunk struct {
+	fourCC string
+	offset int64 // of the chunk header
+	payload []byte
+}
+
+// Returns the JPEG segment equivalent to a WebP metadata chunk, so that the options apply to both alike,
+// and whether the chunk is a metadata chunk at all.
+func (c *riffChunk) segment() (segment, bool) {
+	seg := segment{offset: c.offset, length: len(c.payload), name: strings.TrimRight(c.fourCC, " "), payload: c.payload}
+	switch c.fourCC {
+		case "EXIF":
+			seg.marker, seg.ident = APP1, "EXIF"
+		case "XMP ":
+			seg.marker, seg.ident = APP1, "XMP"
+		case "ICCP":
+			seg.marker, seg.ident = APP2, "ICC"
+		default:
+			return seg, false
+	}
+	return seg, true
+}
+
+// Reads the chunks of a WebP file, returning them along with the length of the file.
+// Trailing data after the RIFF container is left unread.
+func readWebP(ctx context.Context, r io.Reader) (chunks []riffChunk, length int64, err error) {
+	var header [webpHeaderLength]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil { return nil, 0, err }
+	if !isWebP(header[:]) {
+		return nil, 0, &ParseError{Offset: 0, Kind: "expected WebP header"}
+	}
+	size := int64(binary.LittleEndian.Uint32(header[4:]))
+	if size < 4 || size % 2 != 0 {
+		return nil, 0, &ParseError{Offset: 4, Kind: "invalid RIFF size", Msg: fmt.Sprint(size)}
+	}
+	offset := int64(webpHeaderLength)
+	end := 8 + size
+	for offset < end {
+		err = ctx.Err()
+		if err != nil { return nil, 0, err }
+		var chunkHeader [8]byte
+		_, err = io.ReadFull(r, chunkHeader[:])
+		if err != nil { return nil, 0, err }
+		chunkSize := int64(binary.LittleEndian.Uint32(chunkHeader[4:]))
+		paddedSize := chunkSize + chunkSize % 2
+		if offset + 8 + paddedSize > end {
+			return nil, 0, &ParseError{Offset: offset, Kind: "chunk exceeds RIFF size", Msg: fmt.Sprintf("%q", chunkHeader[:4])}
+		}
+		var payload []byte
+		payload, err = readN(r, paddedSize)
+		if err != nil { return nil, 0, err }
+		chunks = append(chunks, riffChunk{fourCC: string(chunkHeader[:4]), offset: offset, payload: payload[:chunkSize]})
+		offset += 8 + paddedSize
+	}
+	return chunks, end, nil
+}
+
+// Writes a WebP file consisting of the chunks.
+func writeWebP(w *bufio.Writer, chunks []riffChunk) error {
+	size := 4
+	for _, chunk := range chunks {
+		size += 8 + len(chunk.payload) + len(chunk.payload) % 2
+	}
+	var header [8]byte
+	copy(header[:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(size))
+	_, err := w.Write(header[:])
+	if err != nil { return err }
+	_, err = w.WriteString("WEBP")
+	if err != nil { return err }
+	for _, chunk := range chunks {
+		copy(header[:], chunk.fourCC)
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(chunk.payload)))
+		_, err = w.Write(header[:])
+		if err != nil { return err }
+		_, err = w.Write(chunk.payload)
+		if err != nil { return err }
+		if len(chunk.payload) % 2 != 0 {
+			err = w.WriteByte(0)
+			if err != nil { return err }
+		}
+	}
+	return nil
+}
+
+// Like mergeJPEG, but for WebP images. The metadata source may be a WebP or a JPEG.
+// Unlike JPEGs, WebP images are read into memory as a whole.
+func mergeWebP(ctx context.Context, out *bufio.Writer, image *bufio.Reader, metadata io.Reader, o *options) error {
+	if o.comment != "" {
+		return errors.New("WebP images can't hold comments")
+	}
+	chunks, length, err := readWebP(ctx, image)
+	if err != nil { return err }
+	var kept []riffChunk
+	for _, chunk := range chunks {
+		seg, isMetadata := chunk.segment()
+		keep := !isMetadata || !o.isMetadataSegment(&seg)
+		if keep && isMetadata && o.rewritesSegment(&seg) {
+			chunk.payload, err = o.rewriteRawEXIF(&seg, chunk.payload)
+			if err != nil { return err }
+			keep = chunk.payload != nil
+		}
+		if o.observe != nil {
+			o.observe(&seg, false, keep)
+		}
+		if keep {
+			kept = append(kept, chunk)
+		}
+	}
+	if metadata != nil {
+		added, err := webpMetadata(ctx, o.newReader(metadata), o)
+		if err != nil { return err }
+		kept = append(kept, added...)
+	}
+	chunks, err = arrangeWebP(kept)
+	if err != nil { return err }
+	err = checkTrailer(image, length, o)
+	if err != nil { return err }
+	err = writeWebP(out, chunks)
+	if err != nil { return err }
+	if o.keepTrailer {
+		_, err = io.Copy(out, image)
+	}
+	return err
+}
+
+// Handles data following the image of the given length according to the trailer options, except for copying it.
+func checkTrailer(image *bufio.Reader, length int64, o *options) error {
+	if o.stripTrailer || o.keepTrailer {
+		return nil
+	}
+	_, err := image.Peek(1)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil { return err }
+	return &ParseError{Offset: length, Kind: "unexpected trailer"}
+}
+
+// Reads the metadata chunks to be copied from a WebP or JPEG metadata source,
+// converting JPEG segments to the equivalent WebP chunks. Only the first item of each kind is used.
+func webpMetadata(ctx context.Context, metadata *bufio.Reader, o *options) ([]riffChunk, error) {
+	items, err := readMetadataItems(ctx, metadata, o)
+	if err != nil { return nil, err }
+	fourCCs := map[string]string{"ICC": "ICCP", "EXIF": "EXIF", "XMP": "XMP "}
+	var added []riffChunk
+	for i := range items {
+		item := &items[i]
+		fourCC, add := fourCCs[item.kind]
+		if add {
+			delete(fourCCs, item.kind)
+			added = append(added, riffChunk{fourCC: fourCC, payload: item.data})
+		}
+		if o.observe != nil {
+			o.observe(&item.seg, true, add)
+		}
+	}
+	return added, nil
+}
+
+// Orders the chunks as the extended format requires and sets the flags of the VP8X chunk accordingly,
+// adding one if there is metadata but none was present.
+func arrangeWebP(chunks []riffChunk) ([]riffChunk, error) {
+	var vp8x, icc, exif, xmp *riffChunk
+	var rest []riffChunk
+	for i := range chunks {
+		chunk := &chunks[i]
+		switch chunk.fourCC {
+			case "VP8X":
+				vp8x = chunk
+			case "ICCP":
+				icc = chunk
+			case "EXIF":
+				exif = chunk
+			case "XMP ":
+				xmp = chunk
+			default:
+				rest = append(rest, *chunk)
+		}
+	}
+	if vp8x == nil && icc == nil && exif == nil && xmp == nil {
+		return rest, nil
+	}
+	if vp8x == nil {
+		payload, err := vp8xFromBitstream(rest)
+		if err != nil { return nil, err }
+		vp8x = &riffChunk{fourCC: "VP8X", payload: payload}
+	} else if len(vp8x.payload) < 10 {
+		return nil, &ParseError{Offset: vp8x.offset, Kind: "truncated VP8X chunk"}
+	}
+	// Don't modify the payload in place, since it may be shared
+	payload := append([]byte(nil), vp8x.payload...)
+	payload[0] &^= vp8xICC | vp8xEXIF | vp8xXMP
+	arranged := []riffChunk{{fourCC: "VP8X", payload: payload}}
+	if icc != nil {
+		payload[0] |= vp8xICC
+		arranged = append(arranged, *icc)
+	}
+	arranged = append(arranged, rest...)
+	if exif != nil {
+		payload[0] |= vp8xEXIF
+		arranged = append(arranged, *exif)
+	}
+	if xmp != nil {
+		payload[0] |= vp8xXMP
+		arranged = append(arranged, *xmp)
+	}
+	return arranged, nil
+}
+
+// Creates the payload of a VP8X chunk for a WebP in the simple format,
+// taking the canvas size from the VP8 or VP8L bitstream.
+func vp8xFromBitstream(chunks []riffChunk) ([]byte, error) {
+	var width, height uint32
+	var flags byte
+	found := false
+	for _, chunk := range chunks {
+		data := chunk.payload
+		switch {
+			case chunk.fourCC == "VP8 " && len(data) >= 10 && bytes.Equal(data[3:6], []byte{0x9D, 0x01, 0x2A}):
+				width = uint32(binary.LittleEndian.Uint16(data[6:]) & 0x3FFF)
+				height = uint32(binary.LittleEndian.Uint16(data[8:]) & 0x3FFF)
+				found = true
+			case chunk.fourCC == "VP8L" && len(data) >= 5 && data[0] == 0x2F:
+				bits := binary.LittleEndian.Uint32(data[1:])
+				width = bits & 0x3FFF + 1
+				height = (bits >> 14) & 0x3FFF + 1
+				if bits & (1 << 28) != 0 {
+					flags |= vp8xAlpha
+				}
+				found = true
+			case chunk.fourCC == "ALPH":
+				flags |= vp8xAlpha
+		}
+	}
+	if !found || width == 0 || height == 0 {
+		return nil, errors.New("can't determine the canvas size of the WebP image")
+	}
+	payload := make([]byte, 10)
+	payload[0] = flags
+	putUint24 := func(b []byte, v uint32) {
+		b[0], b[1], b[2] = byte(v), byte(v >> 8), byte(v >> 16)
+	}
+	putUint24(payload[4:], width - 1)
+	putUint24(payload[7:], height - 1)
+	return payload, nil
+}